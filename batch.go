@@ -0,0 +1,147 @@
+package lmdb
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Group commit
+//
+// Batch coalesces the callbacks passed by concurrent goroutines into a single TransactionalRW, so
+// that they share one commit (and one fsync). Each callback runs in its own nested txn, so a
+// failing callback rolls back its own changes only. A batch starts with the first callback passed
+// to Batch, and runs once it holds the max number of callbacks, or the max delay after it
+// started, whichever comes first (see SetBatchLimits).
+//
+// As with bolt's Batch, a callback that returns an error or panics is removed from the batch and
+// run again alone, in a TransactionalRW of the goroutine that called Batch, whose result is the
+// one returned (or re-panicked). So an error that only happens in a batch (e.g. caused by the
+// changes of the other callbacks) is not returned. If the batch txn itself fails (e.g. it cannot
+// be committed), every callback of the batch is run again alone. A callback failing with
+// ErrMapFull or ErrTxnFull fails the batch txn, which lets TransactionalRW grow the map (see
+// map_size.go). So the callbacks may be run more than once, and must not have side effects
+// outside of the txn.
+
+const (
+	MAX_BATCH_SIZE_DEFAULT  int           = 1000
+	MAX_BATCH_DELAY_DEFAULT time.Duration = 10 * time.Millisecond
+)
+
+// Returned to a caller of Batch whose callback must be run alone.
+var errTrySolo = errors.New("batch callback must be run alone")
+
+type batch struct {
+	db    *Database
+	timer *time.Timer
+	start sync.Once
+	calls []batchCall
+}
+
+type batchCall struct {
+	f   func(*ReadWriteTxn) error
+	err chan<- error
+}
+
+// Runs {f} in a nested txn of a TransactionalRW shared with the callbacks of other goroutines,
+// see "Group commit" in batch.go. Returns the error of {f} run alone, or the error of the txn.
+func (db *Database) Batch(f func(*ReadWriteTxn) error) error {
+	errCh := make(chan error, 1)
+
+	db.batchMu.Lock()
+	if db.batch == nil || len(db.batch.calls) >= db.maxBatchSize {
+		b := &batch{db: db}
+		b.timer = time.AfterFunc(db.maxBatchDelay, b.trigger)
+		db.batch = b
+	}
+	db.batch.calls = append(db.batch.calls, batchCall{f, errCh})
+	if len(db.batch.calls) >= db.maxBatchSize {
+		go db.batch.trigger() // the caller should not wait for the other callbacks to start
+	}
+	db.batchMu.Unlock()
+
+	err := <-errCh
+	if err == errTrySolo {
+		err = db.TransactionalRW(f)
+	}
+	return err
+}
+
+// Sets the max number of callbacks in a batch, and how long a batch waits for more callbacks
+// before it runs, see "Group commit" in batch.go. Batches started already keep their limits.
+// Panics if {maxSize} < 1 or {maxDelay} < 0.
+func (db *Database) SetBatchLimits(maxSize int, maxDelay time.Duration) {
+	if err := validateBatchLimits(maxSize, maxDelay); err != nil {
+		panic(err)
+	}
+	db.batchMu.Lock()
+	defer db.batchMu.Unlock()
+	db.maxBatchSize = maxSize
+	db.maxBatchDelay = maxDelay
+}
+
+func validateBatchLimits(maxSize int, maxDelay time.Duration) error {
+	if maxSize < 1 {
+		return invalidOption("max batch size %d is smaller than 1", maxSize)
+	}
+	if maxDelay < 0 {
+		return invalidOption("max batch delay must not be negative")
+	}
+	return nil
+}
+
+func (b *batch) trigger() {
+	b.start.Do(b.run)
+}
+
+func (b *batch) run() {
+	b.db.batchMu.Lock()
+	b.timer.Stop()
+	if b.db.batch == b { // no more callbacks may join
+		b.db.batch = nil
+	}
+	b.db.batchMu.Unlock()
+
+	// run again by TransactionalRW when the map grows, so the results are reset each time
+	var errs []error
+	err := b.db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		errs = make([]error, len(b.calls))
+		for i, call := range b.calls {
+			errs[i] = runBatchCall(txn, call.f)
+			if isTxnFull(errs[i]) {
+				return errs[i]
+			}
+		}
+		return nil
+	})
+
+	for i, call := range b.calls {
+		if err != nil {
+			call.err <- errTrySolo
+		} else {
+			call.err <- errs[i]
+		}
+	}
+}
+
+// Runs {f} in a nested txn of {txn}. Returns errTrySolo if {f} failed or panicked, but for the
+// errors which must fail the batch txn.
+func runBatchCall(txn *ReadWriteTxn, f func(*ReadWriteTxn) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errTrySolo
+			if e, ok := r.(error); ok {
+				err = e
+			}
+		}
+		if err != nil && !isTxnFull(err) {
+			err = errTrySolo
+		}
+	}()
+	return txn.TransactionalRW(f)
+}
+
+// Whether {err} is caused by the size of the txn, i.e. by the whole batch.
+func isTxnFull(err error) bool {
+	return errors.Is(err, ErrMapFull) || errors.Is(err, ErrTxnFull)
+}
@@ -0,0 +1,132 @@
+package lmdb
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestBatch(t *testing.T) {
+	path, err := ioutil.TempDir("", "lmdb_test")
+	ensure.Nil(t, err)
+	defer os.RemoveAll(path)
+
+	_, err = Open(path, []string{testBucket}, WithBatchLimits(0, time.Second))
+	ensure.True(t, errors.Is(err, ErrInvalidOption))
+
+	// full batches only: the delay never expires
+	db, err := Open(path, []string{testBucket}, WithBatchLimits(10, time.Hour))
+	defer db.Close()
+	ensure.Nil(t, err)
+	before, err := db.lastTxnID()
+	ensure.Nil(t, err)
+
+	errFail := errors.New("fail")
+	var wg sync.WaitGroup
+	errs := make([]error, 100)
+	calls := make([]int32, 100)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = db.Batch(func(txn *ReadWriteTxn) error {
+				atomic.AddInt32(&calls[i], 1)
+				txn.Put(testBucket, []byte(fmt.Sprintf("k%03d", i)), []byte("v"))
+				if i%7 == 0 {
+					return errFail
+				}
+				n := 0
+				if v, ok := txn.Get(testBucket, []byte("count")); ok {
+					fmt.Sscan(string(v), &n)
+				}
+				txn.Put(testBucket, []byte("count"), []byte(fmt.Sprint(n+1)))
+				return nil
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	after, err := db.lastTxnID()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, after-before, uint64(10))
+
+	failed := 0
+	db.TransactionalR(func(txn ReadTxner) {
+		for i, err := range errs {
+			v, ok := txn.Get(testBucket, []byte(fmt.Sprintf("k%03d", i)))
+			if i%7 == 0 { // run again alone, failing again
+				failed++
+				ensure.DeepEqual(t, err, errFail)
+				ensure.False(t, ok)
+				ensure.DeepEqual(t, calls[i], int32(2))
+			} else {
+				ensure.Nil(t, err)
+				ensure.DeepEqual(t, v, []byte("v"))
+				ensure.DeepEqual(t, calls[i], int32(1))
+			}
+		}
+		v, _ := txn.Get(testBucket, []byte("count"))
+		ensure.DeepEqual(t, string(v), fmt.Sprint(100-failed))
+	})
+
+	// a panicking callback is run again alone, in its own goroutine
+	db.SetBatchLimits(2, time.Hour)
+	runs := make(chan string, 3)
+	var panicked interface{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer func() { panicked = recover() }()
+		db.Batch(func(txn *ReadWriteTxn) error {
+			runs <- "panic"
+			txn.Put(testBucket, []byte("panic"), []byte("v"))
+			panic("boom")
+		})
+	}()
+	go func() {
+		defer wg.Done()
+		ensure.Nil(t, db.Batch(func(txn *ReadWriteTxn) error {
+			runs <- "ok"
+			txn.Put(testBucket, []byte("ok"), []byte("v"))
+			return nil
+		}))
+	}()
+	wg.Wait()
+	close(runs)
+
+	ensure.DeepEqual(t, panicked, "boom")
+	count := make(map[string]int)
+	for run := range runs {
+		count[run]++
+	}
+	ensure.DeepEqual(t, count, map[string]int{"panic": 2, "ok": 1})
+	db.TransactionalR(func(txn ReadTxner) {
+		_, ok := txn.Get(testBucket, []byte("panic"))
+		ensure.False(t, ok)
+		v, _ := txn.Get(testBucket, []byte("ok"))
+		ensure.DeepEqual(t, v, []byte("v"))
+	})
+
+	// an error which only happens in the batch is not returned
+	db.SetBatchLimits(1, time.Hour)
+	tries := 0
+	ensure.Nil(t, db.Batch(func(txn *ReadWriteTxn) error {
+		if tries++; tries == 1 {
+			return errFail
+		}
+		txn.Put(testBucket, []byte("retried"), []byte("v"))
+		return nil
+	}))
+	ensure.DeepEqual(t, tries, 2)
+	db.TransactionalR(func(txn ReadTxner) {
+		v, _ := txn.Get(testBucket, []byte("retried"))
+		ensure.DeepEqual(t, v, []byte("v"))
+	})
+}
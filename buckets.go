@@ -0,0 +1,232 @@
+package lmdb
+
+import (
+	"errors"
+	"fmt"
+
+	mdb "github.com/libreoscar/gomdb"
+)
+
+// Buckets
+//
+// Database.buckets maps the names of the buckets to their DBIs, and is shared by all txns.
+// Buckets created or dropped in a write txn are recorded in ReadTxn.bucketChanges instead, so they
+// are visible to that txn (and its nested txns) only, and published to Database.buckets when the
+// top-level txn commits.
+//
+// mdb_drop closes the DBI of a deleted bucket at once, even if the txn is aborted later, and the
+// DBI may then be reused by another bucket, while the read txns begun earlier still see the
+// deleted bucket in their snapshot. So DropBucket only empties the bucket, which is rolled back
+// with the txn, and records it in ReadWriteTxn.drops; the bucket is deleted when the top-level
+// txn commits. It is hidden from the read txns right before (bucketInfo.dropping), and the read
+// txns do not see the buckets published after they began (bucketInfo.gen > ReadTxn.bucketGen),
+// which also hides the buckets reopened after a failed commit. The iterators of a read txn fail
+// with ErrBucketNotFound once their bucket is hidden (see Iterator.checkBucket).
+
+// Flags a bucket is created with. They can not be changed once the bucket exists, and must be
+// declared the same when the bucket is opened: mdb_dbi_open ignores the flags of an existing
+// bucket, and gomdb can not read them back (mdb_dbi_flags).
+type BucketFlags uint
+
+const (
+	// Multiple values per key, sorted, see dupsort.go.
+	DupSort BucketFlags = mdb.DUPSORT
+	// With DupSort: all values of the bucket have the same size.
+	DupFixed BucketFlags = mdb.DUPFIXED
+	// Keys are native-endian uint32 or uint64, see intkey.go.
+	IntegerKey BucketFlags = mdb.INTEGERKEY
+	// With DupSort: values are native-endian uint32 or uint64, see intkey.go.
+	IntegerDup BucketFlags = mdb.INTEGERDUP
+)
+
+func (flags BucketFlags) validate() error {
+	if flags&^(DupSort|DupFixed|IntegerKey|IntegerDup) != 0 {
+		return fmt.Errorf("unknown bucket flags: %#x", uint(flags))
+	}
+	if flags&DupFixed != 0 && flags&DupSort == 0 {
+		return errors.New("DupFixed requires DupSort")
+	}
+	if flags&IntegerDup != 0 && flags&DupSort == 0 {
+		return errors.New("IntegerDup requires DupSort")
+	}
+	return nil
+}
+
+type bucketInfo struct {
+	dbi   mdb.DBI
+	flags BucketFlags
+	// Database.buckets only: the Database.bucketGen the bucket was published in, and whether a
+	// write txn is dropping it.
+	gen      uint64
+	dropping bool
+}
+
+// The DBI of dropped buckets in ReadTxn.bucketChanges. FREE_DBI is never handed out for a bucket.
+const droppedBucket mdb.DBI = 0
+
+func (db *Database) bucket(name string) (bucketInfo, bool) {
+	db.bucketsMu.RLock()
+	defer db.bucketsMu.RUnlock()
+	info, exist := db.buckets[name]
+	return info, exist
+}
+
+func (db *Database) applyBucketChanges(changes map[string]bucketInfo) {
+	if len(changes) == 0 {
+		return
+	}
+
+	db.bucketsMu.Lock()
+	defer db.bucketsMu.Unlock()
+	db.bucketGen++
+	for name, info := range changes {
+		if info.dbi == droppedBucket {
+			delete(db.buckets, name)
+		} else {
+			info.gen = db.bucketGen
+			db.buckets[name] = info
+		}
+	}
+}
+
+func (db *Database) bucketGeneration() uint64 {
+	db.bucketsMu.RLock()
+	defer db.bucketsMu.RUnlock()
+	return db.bucketGen
+}
+
+// Hides the bucket from the read txns, before a committing write txn deletes it.
+func (db *Database) hideBucket(name string) {
+	db.bucketsMu.Lock()
+	defer db.bucketsMu.Unlock()
+	if info, exist := db.buckets[name]; exist && !info.dropping {
+		info.dropping = true
+		db.buckets[name] = info
+		db.bucketGen++
+	}
+}
+
+// Called after a top-level txn which deleted the buckets it dropped failed to commit: the buckets
+// still exist, but their DBIs were closed by mdb_drop, so they are opened again.
+func (db *Database) reopenDroppedBuckets(changes map[string]bucketInfo) error {
+	reopen := make(map[string]BucketFlags)
+	for name := range changes {
+		// an existing bucket can only be changed by dropping it (and maybe creating it again)
+		if info, exist := db.bucket(name); exist {
+			reopen[name] = info.flags
+		}
+	}
+	if len(reopen) == 0 {
+		return nil
+	}
+
+	db.bucketsMu.Lock()
+	for name := range reopen {
+		delete(db.buckets, name)
+	}
+	db.bucketsMu.Unlock()
+	return db.openExistingBuckets(reopen)
+}
+
+// Creates the bucket if it does not exist yet, in a txn of its own.
+func (db *Database) CreateBucket(name string) error {
+	return db.CreateBucketWithFlags(name, 0)
+}
+
+// Creates the bucket with {flags} if it does not exist yet, in a txn of its own.
+func (db *Database) CreateBucketWithFlags(name string, flags BucketFlags) error {
+	return db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		return txn.CreateBucketWithFlags(name, flags)
+	})
+}
+
+// Deletes the bucket and all its contents, in a txn of its own. The read txns using the bucket
+// fail with ErrBucketNotFound once it is deleted, see "Buckets" in buckets.go.
+func (db *Database) DropBucket(name string) error {
+	return db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		return txn.DropBucket(name)
+	})
+}
+
+// Creates the bucket if it does not exist yet. The bucket is visible to other txns only after the
+// top-level txn commits. Fails with ErrTooManyBuckets if the max number of buckets is reached.
+func (txn *ReadWriteTxn) CreateBucket(name string) error {
+	return txn.CreateBucketWithFlags(name, 0)
+}
+
+// Same as CreateBucket, but with {flags}. Fails with ErrIncompatibleBucket if the bucket is open
+// with other flags, or was dropped by the txn with other flags (it is deleted only when the txn
+// commits).
+func (txn *ReadWriteTxn) CreateBucketWithFlags(name string, flags BucketFlags) error {
+	if name == "" {
+		return &Error{"create bucket", name, nil, ErrEmptyBucketName}
+	}
+	if err := flags.validate(); err != nil {
+		return &Error{"create bucket", name, nil, err}
+	}
+	if info, err := txn.bucketInfo(name); err == nil {
+		if info.flags != flags {
+			return &Error{"create bucket", name, nil, ErrIncompatibleBucket}
+		}
+		return nil
+	}
+	if info, dropped := txn.drops[name]; dropped {
+		if info.flags != flags {
+			return &Error{"create bucket", name, nil, ErrIncompatibleBucket}
+		}
+		// the bucket is empty already, it is kept rather than deleted
+		delete(txn.drops, name)
+		txn.bucketChanges[name] = info
+		return nil
+	}
+
+	dbi, err := txn.txn.DBIOpen(&name, mdb.CREATE|uint(flags))
+	if err != nil { // Possible errors: MDB_DBS_FULL, MDB_INCOMPATIBLE, EACCES
+		return wrapError("create bucket", name, nil, err)
+	}
+	txn.bucketChanges[name] = bucketInfo{dbi: dbi, flags: flags}
+	return nil
+}
+
+// Deletes the bucket and all its contents. If the txn is rolled back, the bucket is kept. The
+// read txns using the bucket fail with ErrBucketNotFound once the top-level txn commits, see
+// "Buckets" in buckets.go.
+func (txn *ReadWriteTxn) DropBucket(name string) error {
+	if txn.dirtyKeys != nil {
+		return &Error{"drop bucket", name, nil, ErrDropInPatch}
+	}
+
+	info, err := txn.bucketInfo(name)
+	if err != nil {
+		return err
+	}
+	err = txn.txn.Drop(info.dbi, 0)
+	if err != nil { // Possible errors: EINVAL, EACCES
+		return wrapError("drop bucket", name, nil, err)
+	}
+	if txn.drops == nil {
+		txn.drops = make(map[string]bucketInfo)
+	}
+	txn.drops[name] = info
+	txn.bucketChanges[name] = bucketInfo{dbi: droppedBucket}
+	return nil
+}
+
+// Deletes the buckets dropped by the top-level txn {txn}, which is about to commit.
+func (txn *ReadWriteTxn) deleteDroppedBuckets() error {
+	for name, info := range txn.drops {
+		txn.db.hideBucket(name)
+		if err := txn.txn.Drop(info.dbi, 1); err != nil {
+			return wrapError("drop bucket", name, nil, err)
+		}
+	}
+	return nil
+}
+
+func copyBucketChanges(changes map[string]bucketInfo) map[string]bucketInfo {
+	rst := make(map[string]bucketInfo, len(changes))
+	for name, info := range changes {
+		rst[name] = info
+	}
+	return rst
+}
@@ -0,0 +1,208 @@
+package lmdb
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestCreateDropBucket(t *testing.T) {
+	path, err := ioutil.TempDir("", "lmdb_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(path)
+
+	db, err := Open(path, []string{"bucket1"})
+	defer db.Close()
+	if err != nil {
+		panic(err)
+	}
+
+	ensure.Nil(t, db.CreateBucket("bucket2"))
+	db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		txn.Put("bucket2", []byte("foo"), []byte("bar"))
+		return nil
+	})
+
+	// created in a rolled back txn
+	err = db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		ensure.Nil(t, txn.CreateBucket("bucket3"))
+		txn.Put("bucket3", []byte("foo"), []byte("bar"))
+		return errors.New("rollback")
+	})
+	ensure.NotNil(t, err)
+
+	// dropped in rolled back txns
+	db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		txn.TransactionalRW(func(txn *ReadWriteTxn) error {
+			ensure.Nil(t, txn.DropBucket("bucket2"))
+			_, _, err := txn.TryGet("bucket2", []byte("foo"))
+			ensure.True(t, errors.Is(err, ErrBucketNotFound))
+			return errors.New("rollback")
+		})
+		val, exist := txn.Get("bucket2", []byte("foo"))
+		ensure.True(t, exist)
+		ensure.DeepEqual(t, val, []byte("bar"))
+
+		ensure.Nil(t, txn.DropBucket("bucket2"))
+		return errors.New("rollback")
+	})
+
+	db.TransactionalR(func(txn ReadTxner) {
+		val, exist := txn.Get("bucket2", []byte("foo"))
+		ensure.True(t, exist)
+		ensure.DeepEqual(t, val, []byte("bar"))
+
+		_, _, err := txn.(TryReadTxner).TryGet("bucket3", []byte("foo"))
+		ensure.True(t, errors.Is(err, ErrBucketNotFound))
+	})
+
+	ensure.Nil(t, db.DropBucket("bucket2"))
+	buckets, err := db.GetExistingBuckets()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, buckets, []string{"bucket1"})
+	db.TransactionalR(func(txn ReadTxner) {
+		_, _, err := txn.(TryReadTxner).TryGet("bucket2", []byte("foo"))
+		ensure.True(t, errors.Is(err, ErrBucketNotFound))
+	})
+
+	// created again, empty
+	ensure.Nil(t, db.CreateBucket("bucket2"))
+	db.TransactionalR(func(txn ReadTxner) {
+		ensure.DeepEqual(t, txn.BucketStat("bucket2").Entries, uint64(0))
+	})
+}
+
+func TestTooManyBuckets(t *testing.T) {
+	path, err := ioutil.TempDir("", "lmdb_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(path)
+
+	db, err := Open(path, nil, WithMaxDBs(4))
+	defer db.Close()
+	if err != nil {
+		panic(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		ensure.Nil(t, db.CreateBucket(fmt.Sprintf("bucket%d", i)))
+	}
+	err = db.CreateBucket("one-too-many")
+	ensure.True(t, errors.Is(err, ErrTooManyBuckets))
+
+	ensure.Nil(t, db.DropBucket("bucket0"))
+	ensure.Nil(t, db.CreateBucket("bucket4"))
+}
+
+func TestDropBucket_ConcurrentReader(t *testing.T) {
+	path, err := ioutil.TempDir("", "lmdb_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(path)
+
+	db, err := Open(path, []string{"b"})
+	defer db.Close()
+	if err != nil {
+		panic(err)
+	}
+	db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		txn.Put("b", []byte("k1"), []byte("old"))
+		txn.Put("b", []byte("k2"), []byte("old"))
+		return nil
+	})
+
+	opened, dropped, done := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		db.TransactionalR(func(txner ReadTxner) {
+			txn := txner.(*ReadTxn)
+			itr := txn.Iterate("b")
+			defer itr.Close()
+			close(opened)
+			<-dropped
+
+			// "c" may reuse the DBI of the dropped "b"
+			_, _, err := txn.TryGet("b", []byte("k1"))
+			ensure.True(t, errors.Is(err, ErrBucketNotFound))
+			_, _, err = txn.TryGet("c", []byte("k1"))
+			ensure.True(t, errors.Is(err, ErrBucketNotFound))
+			_, err = itr.TryNext()
+			ensure.True(t, errors.Is(err, ErrBucketNotFound))
+			_, _, err = itr.TryGet()
+			ensure.True(t, errors.Is(err, ErrBucketNotFound))
+		})
+	}()
+
+	<-opened
+	ensure.Nil(t, db.DropBucket("b"))
+	ensure.Nil(t, db.CreateBucket("c"))
+	ensure.Nil(t, db.CreateBucket("b"))
+	close(dropped)
+	<-done
+
+	db.TransactionalR(func(txner ReadTxner) {
+		_, ok := txner.Get("b", []byte("k1"))
+		ensure.False(t, ok)
+		_, ok = txner.Get("c", []byte("k1"))
+		ensure.False(t, ok)
+	})
+}
+
+func TestDropBucket_Rollback(t *testing.T) {
+	path, err := ioutil.TempDir("", "lmdb_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(path)
+
+	db, err := Open(path, []string{"b"}, WithBucketFlags("b", DupSort))
+	defer db.Close()
+	if err != nil {
+		panic(err)
+	}
+	db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		txn.Put("b", []byte("k"), []byte("v"))
+		return nil
+	})
+
+	// a rolled back drop is not seen by the read txns
+	db.TransactionalR(func(txner ReadTxner) {
+		err := db.TransactionalRW(func(txn *ReadWriteTxn) error {
+			ensure.Nil(t, txn.DropBucket("b"))
+			return errors.New("rollback")
+		})
+		ensure.NotNil(t, err)
+		val, ok := txner.Get("b", []byte("k"))
+		ensure.True(t, ok)
+		ensure.DeepEqual(t, val, []byte("v"))
+	})
+
+	// created again in the same txn: with the same flags, empty; with others, not at all
+	db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		ensure.Nil(t, txn.DropBucket("b"))
+		err := txn.CreateBucket("b")
+		ensure.True(t, errors.Is(err, ErrIncompatibleBucket))
+		ensure.Nil(t, txn.CreateBucketWithFlags("b", DupSort))
+		ensure.True(t, txn.IsBucketEmpty("b"))
+		txn.Put("b", []byte("k2"), []byte("v2"))
+		return nil
+	})
+	db.TransactionalR(func(txner ReadTxner) {
+		ensure.DeepEqual(t, txner.BucketStat("b").Entries, uint64(1))
+	})
+
+	_, err = MakePatch(db, func(txn *ReadWriteTxn) error {
+		return txn.DropBucket("b")
+	})
+	ensure.True(t, errors.Is(err, ErrDropInPatch))
+	err = db.CreateBucket("")
+	ensure.True(t, errors.Is(err, ErrEmptyBucketName))
+}
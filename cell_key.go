@@ -1,12 +1,17 @@
 package lmdb
 
-import "encoding/json"
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+)
 
 type CellKey struct {
 	Bucket string
 	Key    []byte
 }
 
+// The JSON form of the key, kept for compatibility. See Encode for a compact one.
 func (ck CellKey) Serialize() string {
 	b, err := json.Marshal(ck)
 	if err != nil {
@@ -19,3 +24,35 @@ func DeserializeCellKey(s string) (rst CellKey, err error) {
 	err = json.Unmarshal([]byte(s), &rst)
 	return
 }
+
+// Binary form of the key: uvarint(len(bucket)) | bucket | key. The encoded keys of a bucket sort
+// like the keys themselves, so they can be used as map keys or sorted keys.
+func (ck CellKey) Encode() string {
+	return string(ck.AppendEncoded(make([]byte, 0, binary.MaxVarintLen64+len(ck.Bucket)+len(ck.Key))))
+}
+
+// Appends the binary form of the key to {dst}, see Encode.
+func (ck CellKey) AppendEncoded(dst []byte) []byte {
+	dst = appendUvarint(dst, uint64(len(ck.Bucket)))
+	dst = append(dst, ck.Bucket...)
+	return append(dst, ck.Key...)
+}
+
+var errBadCellKey = errors.New("bad encoded cell key")
+
+// Decodes the binary form of a key, see Encode. An empty key is decoded as nil.
+func DecodeCellKey(s string) (CellKey, error) {
+	prefix := s
+	if len(prefix) > binary.MaxVarintLen64 {
+		prefix = prefix[:binary.MaxVarintLen64]
+	}
+	n, i := binary.Uvarint([]byte(prefix))
+	if i <= 0 || n > uint64(len(s)-i) { // truncated, overflowing, or longer than the key
+		return CellKey{}, errBadCellKey
+	}
+	ck := CellKey{Bucket: s[i : i+int(n)]}
+	if key := s[i+int(n):]; key != "" {
+		ck.Key = []byte(key)
+	}
+	return ck, nil
+}
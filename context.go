@@ -0,0 +1,66 @@
+package lmdb
+
+import (
+	"context"
+)
+
+// Contexts
+//
+// TransactionalRCtx and TransactionalRWCtx run a txn on behalf of a context. A txn is not begun
+// if the context is done already, and waiting for the writer lock gives up when the context is
+// done. The txn exposes its context (Context, inherited by nested and overlay txns), so that a
+// long callback, e.g. an iteration over a whole bucket, can check it and return ctx.Err(); the
+// context is not checked by the txn methods themselves.
+//
+// Only the top-level write txns of this process wait for the writer lock in a cancellable way:
+// they are serialized on Database.writer before mdb_txn_begin, which may then still block, as
+// long as a write txn of another process is open.
+
+// The txns of this package expose their context, e.g. txn.(ContextTxner).Context() in the
+// callback of TransactionalRCtx.
+type ContextTxner interface {
+	Context() context.Context
+}
+
+// Same as TryTransactionalR, but the txn is not begun if {ctx} is done, in which case
+// ctx.Err() is returned. {ctx} is available to {f} through ContextTxner.
+func (db *Database) TransactionalRCtx(ctx context.Context, f func(ReadTxner) error) error {
+	return db.tryTransactionalR(ctx, f)
+}
+
+// Same as TransactionalRW, but waiting for the writer lock gives up when {ctx} is done, in which
+// case ctx.Err() is returned, and the map does not grow after {ctx} is done. {ctx} is available
+// to {f} through ReadWriteTxn.Context.
+func (db *Database) TransactionalRWCtx(ctx context.Context, f func(*ReadWriteTxn) error) error {
+	return db.transactionalRWCtx(ctx, f)
+}
+
+// Acquires the writer lock, see "Contexts" in context.go.
+func (db *Database) lockWriter(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case db.writer <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (db *Database) unlockWriter() {
+	<-db.writer
+}
+
+// The context the txn runs on behalf of, context.Background() if none was given.
+func (txn *ReadTxn) Context() context.Context {
+	if txn.ctx == nil {
+		return context.Background()
+	}
+	return txn.ctx
+}
+
+// The context of the snapshot of the txn, see ReadTxn.Context.
+func (o *OverlayTxn) Context() context.Context {
+	return o.snap.Context()
+}
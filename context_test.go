@@ -0,0 +1,93 @@
+package lmdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+type ctxKey struct{}
+
+func TestTransactionalCtx(t *testing.T) {
+	path, db := openDupSortDb("lmdb_test")
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	called := false
+	err := db.TransactionalRCtx(canceled, func(ReadTxner) error {
+		called = true
+		return nil
+	})
+	ensure.True(t, errors.Is(err, context.Canceled))
+	err = db.TransactionalRWCtx(canceled, func(*ReadWriteTxn) error {
+		called = true
+		return nil
+	})
+	ensure.True(t, errors.Is(err, context.Canceled))
+	ensure.False(t, called)
+
+	// waiting for the writer lock gives up at the deadline
+	locked, release := make(chan struct{}), make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- db.TransactionalRW(func(txn *ReadWriteTxn) error {
+			close(locked)
+			<-release
+			return nil
+		})
+	}()
+	<-locked
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = db.TransactionalRWCtx(ctx, func(*ReadWriteTxn) error {
+		called = true
+		return nil
+	})
+	ensure.True(t, errors.Is(err, context.DeadlineExceeded))
+	ensure.False(t, called)
+	close(release)
+	ensure.Nil(t, <-done)
+
+	// the context is exposed to the txn and its nested txns
+	ctx = context.WithValue(context.Background(), ctxKey{}, "v")
+	ensure.Nil(t, db.TransactionalRWCtx(ctx, func(txn *ReadWriteTxn) error {
+		ensure.DeepEqual(t, txn.Context().Value(ctxKey{}), "v")
+		for i := 0; i < 10; i++ {
+			txn.Put(testBucket, []byte(fmt.Sprint(i)), []byte("v"))
+		}
+		return txn.TransactionalRW(func(nested *ReadWriteTxn) error {
+			ensure.DeepEqual(t, nested.Context().Value(ctxKey{}), "v")
+			return nil
+		})
+	}))
+	db.TransactionalR(func(txn ReadTxner) {
+		ensure.DeepEqual(t, txn.(ContextTxner).Context(), context.Background())
+	})
+
+	// a long iteration aborts with ctx.Err()
+	ctx, cancel = context.WithCancel(context.Background())
+	visited := 0
+	err = db.TransactionalRCtx(ctx, func(txn ReadTxner) error {
+		for itr := txn.Iterate(testBucket); itr != nil; {
+			if err := txn.(ContextTxner).Context().Err(); err != nil {
+				return err
+			}
+			if visited++; visited == 3 {
+				cancel()
+			}
+			if !itr.Next() {
+				break
+			}
+		}
+		return nil
+	})
+	ensure.True(t, errors.Is(err, context.Canceled))
+	ensure.DeepEqual(t, visited, 3)
+}
@@ -1,10 +1,14 @@
 package lmdb
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	mdb "github.com/libreoscar/gomdb"
 	"log"
+	"runtime"
+	"sync"
+	"time"
 )
 
 // Thread Safety
@@ -15,7 +19,9 @@ import (
 //    only makes sense to have a single caller, except in the case of Database.
 // 3) Most Database methods are thread-safe, and may be called concurrently, except for
 //    Database.Close().
-// 4) A write txn may only be used from the thread it was created on.
+// 4) A write txn may only be used from the thread it was created on. TransactionalRW and
+//    BeginWrite lock the goroutine to its thread (runtime.LockOSThread) until the txn ends, and
+//    DebugTxnGoroutine (see debug.go) catches the use of a write txn by other goroutines.
 // 5) A read-only txn can move across threads, but it cannot be used concurrently from multiple
 //    threads.
 // 6) Iterator is not thread-safe, but it does not make sense to use it on any thread except the
@@ -30,7 +36,8 @@ import (
 
 const (
 	// There is no penalty for making this huge.
-	// If you are on a 32-bit system, use Open2 and specify a smaller map size.
+	// If you are on a 32-bit system, use Open2 and specify a smaller map size, optionally letting
+	// it grow on demand with Database.SetMapGrowth.
 	MAP_SIZE_DEFAULT uint64 = 1 * 1024 * 1024 * 1024 * 1024 // 1TB
 
 	// http://www.openldap.org/lists/openldap-technical/201305/msg00176.html
@@ -63,31 +70,72 @@ func DryRunRWTxn(rwtxner RWTxnCreator, f func(*ReadWriteTxn) error) error {
 	return err
 }
 
-// a make-patch is a dry-run with a patch as its return value
-func MakePatch(rwtxner RWTxnCreator, f func(*ReadWriteTxn) error) (patch TxnPatch, err error) {
-	rwtxner.TransactionalRW(func(rwtxn *ReadWriteTxn) error {
-		origin := rwtxn.dirtyKeys
-		rwtxn.dirtyKeys = make(map[string]bool)
-		err = f(rwtxn)
-		if err == nil {
-			for serializedCellKey := range rwtxn.dirtyKeys {
-				cellKey, err2 := DeserializeCellKey(serializedCellKey)
-				if err2 != nil {
-					panic(fmt.Errorf("deserialization error: %s, serialized key = %v",
-						err2.Error(), serializedCellKey))
-				}
-				cell := cellState{bucket: cellKey.Bucket, key: cellKey.Key}
-				cell.value, cell.exists = rwtxn.Get(cellKey.Bucket, cellKey.Key)
+// a make-patch is a dry-run with a patch as its return value, in canonical order (see TxnPatch)
+func MakePatch(rwtxner RWTxnCreator, f func(*ReadWriteTxn) error) (TxnPatch, error) {
+	patch, _, err := makePatch(rwtxner, f, false, false)
+	return patch, err
+}
+
+// Same as MakePatch, but each cell also records the state of its key before the txn, so that the
+// patch can be undone, see TxnPatch.Inverse.
+func MakeReversiblePatch(rwtxner RWTxnCreator, f func(*ReadWriteTxn) error) (TxnPatch, error) {
+	patch, _, err := makePatch(rwtxner, f, true, false)
+	return patch, err
+}
+
+// Same as MakePatch (MakeReversiblePatch if {reversible}), but also returns the keys and ranges of
+// keys read by the txn, see "Read sets" in read_set.go.
+func MakePatchWithReadSet(rwtxner RWTxnCreator, f func(*ReadWriteTxn) error,
+	reversible bool) (TxnPatch, *ReadSet, error) {
+	return makePatch(rwtxner, f, reversible, true)
+}
+
+func makePatch(rwtxner RWTxnCreator, f func(*ReadWriteTxn) error,
+	reversible, trackReads bool) (patch TxnPatch, reads *ReadSet, err error) {
+	err = rwtxner.TransactionalRW(func(rwtxn *ReadWriteTxn) error {
+		origin, originPriors, originReads := rwtxn.dirtyKeys, rwtxn.recordPriors, rwtxn.reads
+		rwtxn.dirtyKeys, rwtxn.recordPriors = make(map[string]*CellState), reversible
+		if trackReads || originReads != nil {
+			rwtxn.reads = newReadSet()
+		}
+		defer func() {
+			if trackReads {
+				reads = rwtxn.reads.export()
+			}
+			originReads.merge(rwtxn.reads) // the enclosing txn depends on the reads as well
+			rwtxn.dirtyKeys, rwtxn.recordPriors, rwtxn.reads = origin, originPriors, originReads
+		}()
+
+		if err := f(rwtxn); err != nil {
+			return err
+		}
+		for encodedCellKey, prior := range rwtxn.dirtyKeys {
+			cellKey, err := DecodeCellKey(encodedCellKey)
+			if err != nil {
+				panic(fmt.Errorf("%v: %q", err, encodedCellKey))
+			}
+			if len(cellKey.Key) == 0 { // see markCleared
+				cell := NewClearCell(cellKey.Bucket)
+				cell.Prior = prior
 				patch = append(patch, cell)
+				continue
 			}
-			err = dryRunDummyError{}
+			state, err := rwtxn.tryGetCellState(cellKey.Bucket, cellKey.Key)
+			if err != nil {
+				return err
+			}
+			patch = append(patch, PatchCell{Bucket: cellKey.Bucket, Key: cellKey.Key,
+				CellState: state, Prior: prior})
 		}
-		rwtxn.dirtyKeys = origin
-		return err
+		patch.sortCells()
+		patch = patch.dropClearedDeletes()
+		return dryRunDummyError{}
 	})
 
 	if _, ok := err.(dryRunDummyError); ok {
 		err = nil
+	} else {
+		patch, reads = nil, nil
 	}
 	return
 }
@@ -96,9 +144,46 @@ func MakePatch(rwtxner RWTxnCreator, f func(*ReadWriteTxn) error) (patch TxnPatc
 
 type Database struct {
 	env *mdb.Env
-	// In this package, a DBI is obtained only through Open/Open2, and is never closed until
-	// Context.Close(), in which all dbis are closed automatically.
-	buckets map[string]mdb.DBI
+	// In this package, a DBI is obtained through Open/Open2 or CreateBucket, and is never closed
+	// until DropBucket or Context.Close(), in which all dbis are closed automatically.
+	// See buckets.go.
+	bucketsMu sync.RWMutex
+	buckets   map[string]bucketInfo
+	bucketGen uint64 // incremented each time buckets are published or hidden
+
+	// See map_size.go
+	txnsMu     sync.Mutex
+	txnsDone   *sync.Cond // signaled when no txn is open anymore, and when a resize ends
+	activeTxns int        // top-level txns currently open on env, but the long-lived ones
+	heldTxns   int        // long-lived top-level txns currently open on env
+	resizing   int        // resizes waiting for the txns to finish, new txns wait for them
+	resizeWait time.Duration
+	mapSize    uint64
+	growthStep uint64
+	maxMapSize uint64
+
+	// See batch.go
+	batchMu       sync.Mutex
+	batch         *batch // the batch open to new callbacks, nil if none
+	maxBatchSize  int
+	maxBatchDelay time.Duration
+
+	// See context.go
+	writer chan struct{} // holds a token while a top-level write txn is open in this process
+
+	// See debug.go
+	debug DebugFlags
+
+	// See snapshot.go
+	poolMu       sync.Mutex
+	readPool     []*mdb.Txn // reset read txns
+	readPoolSize int
+	closed       bool // no more txns are pooled
+
+	// See nocopy.go
+	protected protectedCopies
+
+	readOnly bool
 }
 
 type Stat mdb.Stat
@@ -108,13 +193,34 @@ func Version() string {
 	return mdb.Version()
 }
 
-func Open(path string, buckets []string) (*Database, error) {
-	return Open2(path, buckets, MAP_SIZE_DEFAULT, MAX_DB_DEFAULT)
-}
-
-func Open2(path string, buckets []string, maxMapSize uint64, maxDB int) (db *Database, err error) {
-	if maxDB < len(buckets) {
-		maxDB = len(buckets)
+// Opens the environment at {path}, creating the {buckets} that do not exist yet.
+// See options.go for the available options.
+//
+// The returned Database is never nil, even on error, and can always be closed.
+func Open(path string, buckets []string, opts ...Option) (db *Database, err error) {
+	db = &Database{buckets: make(map[string]bucketInfo), writer: make(chan struct{}, 1)}
+	db.txnsDone = sync.NewCond(&db.txnsMu)
+	db.resizeWait = resizeWaitDefault
+
+	o := defaultOptions()
+	for _, opt := range opts {
+		if err = opt(&o); err != nil {
+			return
+		}
+	}
+	if err = o.validate(buckets); err != nil {
+		return
+	}
+	if o.maxDBs < len(buckets) {
+		o.maxDBs = len(buckets)
+	}
+	db.readOnly = o.flags&envReadOnly != 0
+	db.growthStep, db.maxMapSize = o.growthStep, o.maxMapSize
+	db.maxBatchSize, db.maxBatchDelay = o.maxBatchSize, o.maxBatchDelay
+	db.debug = o.debug
+	db.readPoolSize = o.readPoolSize
+	if o.maxReaders != 0 && uint(db.readPoolSize) > o.maxReaders/2 {
+		db.readPoolSize = int(o.maxReaders / 2) // pooled txns keep their reader slots
 	}
 
 	// TODO: (Potential bug):
@@ -123,7 +229,7 @@ func Open2(path string, buckets []string, maxMapSize uint64, maxDB int) (db *Dat
 	// But mdb.NewEnv doesnot call mdb_env_close() when it fails, AND it just return nil as env.
 	// Patch gomdb if this turns out to be a big issue.
 	env, err := mdb.NewEnv()
-	db = &Database{env, make(map[string]mdb.DBI)}
+	db.env = env
 	defer func() {
 		if err != nil && env != nil {
 			log.Printf("[ERROR] Open db failed. %v", err)
@@ -132,66 +238,133 @@ func Open2(path string, buckets []string, maxMapSize uint64, maxDB int) (db *Dat
 		}
 	}()
 	if err != nil {
+		err = wrapError("create env", "", nil, err)
 		return
 	}
 
-	err = env.SetMapSize(maxMapSize)
+	err = env.SetMapSize(o.mapSize)
 	if err != nil {
+		err = wrapError("set map size", "", nil, err)
 		return
 	}
 
-	err = env.SetMaxDBs(mdb.DBI(maxDB))
+	err = env.SetMaxDBs(mdb.DBI(o.maxDBs))
 	if err != nil {
+		err = wrapError("set max dbs", "", nil, err)
 		return
 	}
 
-	MDB_NOTLS := uint(0x200000)
-	MDB_NORDAHEAD := uint(0x800000)
-	err = env.Open(path, MDB_NOTLS|MDB_NORDAHEAD, 0664)
+	if o.maxReaders != 0 {
+		err = env.SetMaxReaders(o.maxReaders)
+		if err != nil {
+			err = wrapError("set max readers", "", nil, err)
+			return
+		}
+	}
+
+	err = env.Open(path, envNoTLS|o.flags, uint32(o.mode))
+	if err != nil {
+		err = wrapError("open env", "", nil, err)
+		return
+	}
+
+	// an existing environment may have a larger map than requested
+	info, err := env.Info()
 	if err != nil {
+		err = wrapError("info", "", nil, err)
 		return
 	}
+	db.mapSize = info.MapSize
 
-	err = db.openBuckets(buckets)
+	bucketFlags := make(map[string]BucketFlags)
+	for _, name := range buckets {
+		bucketFlags[name] = o.bucketFlags[name]
+	}
+	err = db.openBuckets(bucketFlags)
 	return
 }
 
-func (db *Database) openBuckets(buckets []string) error {
-	return db.TransactionalRW(func(txn *ReadWriteTxn) error {
-		for _, name := range buckets {
-			if name == "" {
-				return errors.New("Bucket name is empty")
-			}
+// Same as Open with WithMapSize and WithMaxDBs, but with the semantics Open2 always had: a
+// {maxMapSize} of 0 lets LMDB choose the map size (its default, or the size of an existing
+// environment), and a negative {maxDB} is raised to the number of buckets.
+func Open2(path string, buckets []string, maxMapSize uint64, maxDB int) (*Database, error) {
+	if maxDB < 0 {
+		maxDB = 0
+	}
+	mapSize := func(o *options) error { // not validated by WithMapSize
+		o.mapSize = maxMapSize
+		return nil
+	}
+	return Open(path, buckets, mapSize, WithMaxDBs(maxDB))
+}
 
-			_, exist := db.buckets[name]
-			if exist {
-				continue
-			}
+func (db *Database) openBuckets(buckets map[string]BucketFlags) error {
+	if db.readOnly {
+		return db.openExistingBuckets(buckets)
+	}
 
-			dbi, err := txn.txn.DBIOpen(&name, mdb.CREATE)
-			if err != nil {
+	return db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		for name, flags := range buckets {
+			if err := txn.CreateBucketWithFlags(name, flags); err != nil {
 				return err
-			} else {
-				db.buckets[name] = dbi
 			}
 		}
 		return nil
 	})
 }
 
+// The read-only counterpart of openBuckets: DBIs are opened in a read txn, which must be
+// committed to keep them.
+func (db *Database) openExistingBuckets(buckets map[string]BucketFlags) error {
+	txn, _, err := db.beginTxn(mdb.RDONLY)
+	if err != nil {
+		return wrapError("begin read txn", "", nil, err)
+	}
+	defer db.exitTxn()
+
+	opened := make(map[string]bucketInfo)
+	for name, flags := range buckets {
+		if name == "" {
+			txn.Abort()
+			return &Error{"open bucket", name, nil, ErrEmptyBucketName}
+		}
+		if _, exist := db.bucket(name); exist {
+			continue
+		}
+
+		dbi, err := txn.DBIOpen(&name, uint(flags))
+		if err == mdb.NotFound {
+			txn.Abort()
+			return &Error{"open bucket", name, nil, ErrBucketNotFound}
+		} else if err != nil {
+			txn.Abort()
+			return wrapError("open bucket", name, nil, err)
+		}
+		opened[name] = bucketInfo{dbi: dbi, flags: flags}
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		return wrapError("commit read txn", "", nil, err)
+	}
+	db.applyBucketChanges(opened)
+	return nil
+}
+
 func (db *Database) GetExistingBuckets() (buckets []string, err error) {
-	db.TransactionalRW(func(txn *ReadWriteTxn) error {
-		dbi, err := txn.txn.DBIOpen(nil, mdb.CREATE)
+	err = db.TryTransactionalR(func(txner ReadTxner) error {
+		txn := txner.(*ReadTxn)
+		dbi, err := txn.txn.DBIOpen(nil, 0)
 		if err != nil {
-			return err
+			return wrapError("open main db", "", nil, err)
 		}
 
 		cur, err := txn.txn.CursorOpen(dbi)
 		if err != nil {
-			return err
+			return wrapError("open cursor", "", nil, err)
 		}
 
-		itr := (*Iterator)(cur)
+		itr := newIterator(cur, iterState{})
 		defer itr.Close()
 		if !itr.SeekFirst() {
 			return nil
@@ -211,6 +384,8 @@ func (db *Database) GetExistingBuckets() (buckets []string, err error) {
 }
 
 func (db *Database) Close() {
+	db.drainReadPool()
+	db.protected.close()
 	if db.env != nil {
 		db.env.Close() // all opened dbis are closed during this process
 	}
@@ -219,7 +394,7 @@ func (db *Database) Close() {
 func (db *Database) Stat() *Stat {
 	stat, err := db.env.Stat()
 	if err != nil { // Possible errors: EINVAL
-		panic(err)
+		panic(wrapError("stat", "", nil, err))
 	}
 	return (*Stat)(stat)
 }
@@ -227,27 +402,44 @@ func (db *Database) Stat() *Stat {
 func (db *Database) Info() *Info {
 	info, err := db.env.Info()
 	if err != nil { // error when env == nil, so panic
-		panic(err)
+		panic(wrapError("info", "", nil, err))
 	}
 	return (*Info)(info)
 }
 
+// Errors from beginning the txn (MDB_READERS_FULL, MDB_MAP_RESIZED...) panic.
+// See TryTransactionalR for a variant that returns them.
 func (db *Database) TransactionalR(f func(ReadTxner)) {
-	txn, err := db.env.BeginTxn(nil, mdb.RDONLY)
-	if err != nil { // Possible Errors: MDB_PANIC, MDB_MAP_RESIZED, MDB_READERS_FULL, ENOMEM
+	err := db.TryTransactionalR(func(txn ReadTxner) error {
+		f(txn)
+		return nil
+	})
+	if err != nil {
 		panic(err)
 	}
+}
+
+// Same as TransactionalR, but errors from beginning the txn are returned instead of panicking,
+// and so is the error returned by {f}.
+func (db *Database) TryTransactionalR(f func(ReadTxner) error) error {
+	return db.tryTransactionalR(context.Background(), f)
+}
+
+func (db *Database) tryTransactionalR(ctx context.Context, f func(ReadTxner) error) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError("begin read txn", "", nil, err)
+	}
+	gen := db.bucketGeneration()
+	txn, err := db.beginReadTxn()
+	if err != nil { // Possible Errors: MDB_PANIC, MDB_READERS_FULL, ENOMEM
+		return wrapError("begin read txn", "", nil, err)
+	}
 
 	var panicF interface{} // panic from f
-	rdTxn := ReadTxn{db.buckets, txn, nil}
+	rdTxn := ReadTxn{db: db, txn: txn, ctx: ctx, bucketGen: gen}
 
 	defer func() {
-		for _, itr := range rdTxn.itrs {
-			itr.Close() // no panic
-		}
-		rdTxn.itrs = nil
-
-		txn.Abort()
+		rdTxn.end()
 		if panicF != nil {
 			panic(panicF) // re-panic
 		}
@@ -257,35 +449,103 @@ func (db *Database) TransactionalR(f func(ReadTxner)) {
 		defer func() {
 			panicF = recover()
 		}()
-		f(&rdTxn)
+		err = f(&rdTxn)
 	}()
+	return err
 }
 
+// Errors from beginning or committing the txn are returned rather than panicking.
+//
+// If map growth is enabled (see SetMapGrowth) and the txn fails with ErrMapFull, either returned
+// or panicked by {f}, the map is grown and {f} is run again in a new txn.
 func (db *Database) TransactionalRW(f func(*ReadWriteTxn) error) (err error) {
-	txn, err := db.env.BeginTxn(nil, 0)
-	if err != nil { // Possible Errors: MDB_PANIC, MDB_MAP_RESIZED, MDB_READERS_FULL, ENOMEM
-		panic(err)
+	return db.transactionalRWCtx(context.Background(), f)
+}
+
+func (db *Database) transactionalRWCtx(ctx context.Context, f func(*ReadWriteTxn) error) (
+	err error) {
+
+	if err := db.lockWriter(ctx); err != nil {
+		return wrapError("begin txn", "", nil, err)
+	}
+	defer db.unlockWriter()
+	runtime.LockOSThread() // see "Thread Safety"
+	defer runtime.UnlockOSThread()
+
+	for {
+		txn, mapSize, e := db.beginTxn(0)
+		if e != nil { // Possible Errors: MDB_PANIC, MDB_READERS_FULL, ENOMEM
+			return wrapError("begin txn", "", nil, e)
+		}
+
+		var panicF interface{}
+		func() {
+			defer db.exitTxn()
+			panicF, err = db.transactionalRW(ctx, txn, f)
+		}()
+
+		mapFull := errors.Is(err, ErrMapFull)
+		if e, ok := panicF.(error); ok && errors.Is(e, ErrMapFull) {
+			mapFull = true
+		}
+		if mapFull && ctx.Err() == nil && db.growMap(mapSize) {
+			continue
+		}
+
+		if panicF != nil {
+			panic(panicF) // re-panic
+		}
+		return
 	}
+}
 
-	var panicF interface{} // panic from f
-	rwCtx := ReadWriteTxn{db.env, &ReadTxn{db.buckets, txn, nil}, nil}
+// Closes the iterators of the top-level read txn {txn}, begun by beginReadTxn, and ends it.
+func (txn *ReadTxn) end() {
+	txn.closeIterators(0)
+	txn.endNoCopies()
+	txn.db.endReadTxn(txn.txn, txn.held)
+}
 
-	defer func() {
-		for _, itr := range rwCtx.itrs {
-			itr.Close() // no panic
+// Closes the iterators of the top-level write txn {txn}, and commits it if {commit}, else aborts
+// it. Returns the error of the commit.
+func (txn *ReadWriteTxn) end(commit bool) (err error) {
+	for _, itr := range txn.itrs {
+		itr.Close() // no panic
+	}
+	txn.itrs = nil
+	txn.endNoCopies()
+
+	if commit {
+		err = txn.deleteDroppedBuckets()
+	}
+	if commit && err == nil {
+		// Possible errors: EINVAL, ENOSPEC, EIO, ENOMEM, MDB_MAP_FULL
+		err = wrapError("commit txn", "", nil, txn.txn.Commit())
+	} else {
+		txn.txn.Abort()
+	}
+
+	if commit && err == nil {
+		txn.db.applyBucketChanges(txn.bucketChanges)
+	} else if commit {
+		if e := txn.db.reopenDroppedBuckets(txn.drops); e != nil {
+			log.Printf("[ERROR] Reopening dropped buckets failed. %v", e)
 		}
-		rwCtx.itrs = nil
+	}
+	return err
+}
 
-		if err == nil && panicF == nil {
-			e := txn.Commit()
-			if e != nil { // Possible errors: EINVAL, ENOSPEC, EIO, ENOMEM
-				panic(e)
-			}
-		} else {
-			txn.Abort()
-			if panicF != nil {
-				panic(panicF) // re-panic
-			}
+// Runs {f} in {txn} and commits or aborts it. A panic from {f} is returned rather than re-panicked.
+func (db *Database) transactionalRW(ctx context.Context, txn *mdb.Txn,
+	f func(*ReadWriteTxn) error) (panicF interface{}, err error) {
+
+	rwCtx := ReadWriteTxn{env: db.env,
+		ReadTxn: &ReadTxn{db: db, txn: txn, ctx: ctx, owner: db.txnOwner()}}
+	rwCtx.bucketChanges = make(map[string]bucketInfo)
+
+	defer func() {
+		if e := rwCtx.end(err == nil && panicF == nil); err == nil {
+			err = e
 		}
 	}()
 
@@ -0,0 +1,81 @@
+package lmdb
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strconv"
+)
+
+// Debug modes
+//
+// Checks of the API usage that are too costly to be always on, enabled with WithDebug.
+
+type DebugFlags uint
+
+const (
+	// Records the call site of BeginRead/BeginWrite/Snapshot, so that a handle or snapshot which
+	// is never finished is reported with it, and panics when a write handle is never finished,
+	// see "Explicit txns" in handle.go.
+	DebugUnfinishedTxns DebugFlags = 1 << iota
+	// Panics when a write txn, one of its nested txns, or one of their iterators, is used by
+	// another goroutine than the one running the txn, see "Thread Safety" in database.go.
+	DebugTxnGoroutine
+	// Checks the use of the results of GetNoCopy and Iterator.GetNoCopy, at the cost of copying
+	// them, see "Checked NoCopy results" in nocopy.go.
+	DebugNoCopy
+)
+
+// Enables the debug modes in {flags}, see "Debug modes" in debug.go.
+func WithDebug(flags DebugFlags) Option {
+	return func(o *options) error {
+		o.debug |= flags
+		return nil
+	}
+}
+
+// The stack of the calling goroutine.
+func callerStack() string {
+	buf := make([]byte, 4096)
+	buf = buf[:runtime.Stack(buf, false)]
+	return string(buf)
+}
+
+// The goroutine to record as the owner of a new write txn, 0 unless DebugTxnGoroutine.
+func (db *Database) txnOwner() int64 {
+	if db.debug&DebugTxnGoroutine == 0 {
+		return 0
+	}
+	return goroutineID()
+}
+
+func (txn *ReadTxn) checkOwner() {
+	checkOwner(txn.owner, "txn")
+}
+
+func (itr *iterState) checkOwner() {
+	checkOwner(itr.owner, "iterator")
+}
+
+// Panics if {owner} is set and is not the calling goroutine, see DebugTxnGoroutine.
+func checkOwner(owner int64, what string) {
+	if owner == 0 {
+		return
+	}
+	if g := goroutineID(); g != owner {
+		panic(fmt.Errorf("lmdb: a write %s is used by goroutine %d, but its txn is run by "+
+			"goroutine %d; a write txn and its iterators must only be used by that goroutine",
+			what, g, owner))
+	}
+}
+
+// The id of the calling goroutine, parsed from its stack: the runtime does not expose it.
+func goroutineID() int64 {
+	var buf [64]byte
+	b := bytes.TrimPrefix(buf[:runtime.Stack(buf[:], false)], []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i >= 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseInt(string(b), 10, 64)
+	return id
+}
@@ -0,0 +1,69 @@
+package lmdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+// Runs {f} in another goroutine, and returns what it panicked with.
+func panicInGoroutine(f func()) (panicF interface{}) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer func() { panicF = recover() }()
+		f()
+	}()
+	<-done
+	return
+}
+
+func TestDebugTxnGoroutine(t *testing.T) {
+	path, err := ioutil.TempDir("", "lmdb_test")
+	ensure.Nil(t, err)
+	defer os.RemoveAll(path)
+	db, err := Open(path, []string{testBucket}, WithDebug(DebugTxnGoroutine))
+	defer db.Close()
+	ensure.Nil(t, err)
+
+	ensureOwnerPanic := func(panicF interface{}, what string) {
+		msg := fmt.Sprint(panicF)
+		ensure.True(t, strings.Contains(msg, "a write "+what+" is used by goroutine"), msg)
+	}
+
+	ensure.Nil(t, db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		txn.Put(testBucket, []byte("a"), []byte("1"))
+		itr := txn.Iterate(testBucket)
+		ensure.NotNil(t, itr)
+
+		ensureOwnerPanic(panicInGoroutine(func() { txn.Get(testBucket, []byte("a")) }), "txn")
+		ensureOwnerPanic(panicInGoroutine(func() { itr.Next() }), "iterator")
+		ensureOwnerPanic(panicInGoroutine(func() {
+			txn.TransactionalRW(func(*ReadWriteTxn) error { return nil })
+		}), "txn")
+
+		return txn.TransactionalRW(func(nested *ReadWriteTxn) error {
+			nested.Put(testBucket, []byte("b"), []byte("2"))
+			ensureOwnerPanic(panicInGoroutine(func() { nested.Delete(testBucket, []byte("b")) }),
+				"txn")
+			return nil
+		})
+	}))
+
+	h, err := db.BeginWrite()
+	ensure.Nil(t, err)
+	ensureOwnerPanic(panicInGoroutine(func() { h.Commit() }), "txn")
+	ensure.Nil(t, h.Commit())
+
+	// read txns may move across goroutines
+	db.TransactionalR(func(txn ReadTxner) {
+		ensure.Nil(t, panicInGoroutine(func() {
+			v, _ := txn.Get(testBucket, []byte("b"))
+			ensure.DeepEqual(t, v, []byte("2"))
+		}))
+	})
+}
@@ -0,0 +1,310 @@
+package lmdb
+
+import (
+	mdb "github.com/libreoscar/gomdb"
+)
+
+// DupSort buckets
+//
+// A bucket created with DupSort maps a key to a sorted set of values. Put adds a value to the set
+// of a key rather than replacing it, Delete removes the key with all its values, and Get returns
+// the smallest value of the key. Iterators visit every (key, value) pair, see NextDup etc. to move
+// within or across the values of a key.
+//
+// The keys and the values of a DupSort bucket are limited to 511 bytes each. With IntegerDup, the
+// values are integers, see intkey.go.
+
+// The reads of DupSort buckets, implemented by the txns of this package.
+type DupSortReader interface {
+	GetAll(bucket string, key []byte) [][]byte
+	CountDups(bucket string, key []byte) uint64
+	TryGetAll(bucket string, key []byte) ([][]byte, error)
+	TryCountDups(bucket string, key []byte) (uint64, error)
+}
+
+// Returns the info of {bucket}, or an error if it does not exist or is not DupSort.
+func (txn *ReadTxn) dupSortBucket(bucket string) (bucketInfo, error) {
+	info, err := txn.bucketInfo(bucket)
+	if err == nil && info.flags&DupSort == 0 {
+		err = &Error{"open bucket", bucket, nil, ErrNotDupSort}
+	}
+	return info, err
+}
+
+// Opens a cursor positioned at the first value of {key}. Returns nil if {key} does not exist.
+func (txn *ReadTxn) seekDups(bucket string, key []byte) (*Iterator, error) {
+	info, err := txn.dupSortBucket(bucket)
+	if err == nil {
+		err = txn.checkSizes("seek", bucket, info, key, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cur, err := txn.txn.CursorOpen(info.dbi)
+	if err != nil {
+		return nil, wrapError("open cursor", bucket, nil, err)
+	}
+
+	itr := newIterator(cur, iterState{bucket: bucket, owner: txn.owner, txn: txn, dbi: info.dbi,
+		gen: txn.bucketGen})
+	_, _, err = cur.GetVal(key, nil, mdb.SET)
+	if err != nil {
+		itr.Close()
+		if err == mdb.NotFound {
+			return nil, nil
+		}
+		return nil, wrapError("seek", bucket, key, err)
+	}
+	return itr, nil
+}
+
+// Returns all values of {key} in order, or nil if {key} does not exist.
+func (txn *ReadTxn) TryGetAll(bucket string, key []byte) ([][]byte, error) {
+	txn.reads.recordKey(bucket, key)
+	return txn.getAll(bucket, key)
+}
+
+func (txn *ReadTxn) getAll(bucket string, key []byte) ([][]byte, error) {
+	itr, err := txn.seekDups(bucket, key)
+	if itr == nil {
+		return nil, err
+	}
+	defer itr.Close()
+
+	var vals [][]byte
+	for {
+		_, val, err := itr.TryGet()
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, val)
+
+		ok, err := itr.TryNextDup()
+		if err != nil {
+			return nil, err
+		} else if !ok {
+			return vals, nil
+		}
+	}
+}
+
+// Panic if {bucket} does not exist or is not DupSort.
+func (txn *ReadTxn) GetAll(bucket string, key []byte) [][]byte {
+	vals, err := txn.TryGetAll(bucket, key)
+	if err != nil {
+		panic(err)
+	}
+	return vals
+}
+
+// Returns the number of values of {key}, 0 if {key} does not exist.
+func (txn *ReadTxn) TryCountDups(bucket string, key []byte) (uint64, error) {
+	txn.reads.recordKey(bucket, key)
+	return txn.countDups(bucket, key)
+}
+
+func (txn *ReadTxn) countDups(bucket string, key []byte) (uint64, error) {
+	itr, err := txn.seekDups(bucket, key)
+	if itr == nil {
+		return 0, err
+	}
+	defer itr.Close()
+	return itr.TryCountDups()
+}
+
+// Panic if {bucket} does not exist or is not DupSort.
+func (txn *ReadTxn) CountDups(bucket string, key []byte) uint64 {
+	n, err := txn.TryCountDups(bucket, key)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// Adds {val} to the values of {key}. Adding an existing value is not an error.
+func (txn *ReadWriteTxn) TryPutDup(bucket string, key, val []byte) error {
+	if _, err := txn.dupSortBucket(bucket); err != nil {
+		return err
+	}
+	return txn.TryPut(bucket, key, val)
+}
+
+func (txn *ReadWriteTxn) PutDup(bucket string, key, val []byte) {
+	err := txn.TryPutDup(bucket, key, val)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Removes {val} from the values of {key}. Deleting a non-existing value is not an error.
+func (txn *ReadWriteTxn) TryDeleteDup(bucket string, key, val []byte) error {
+	info, err := txn.dupSortBucket(bucket)
+	if err == nil {
+		err = txn.checkSizes("delete dup", bucket, info, key, val)
+	}
+	if err == nil {
+		err = txn.markDirty(bucket, key)
+	}
+	if err != nil {
+		return err
+	}
+	err = txn.txn.Del(info.dbi, key, val)
+	if err != nil && err != mdb.NotFound { // Possible errors: EINVAL, EACCES, MDB_BAD_TXN
+		return wrapError("delete dup", bucket, key, err)
+	}
+	return nil
+}
+
+func (txn *ReadWriteTxn) DeleteDup(bucket string, key, val []byte) {
+	err := txn.TryDeleteDup(bucket, key, val)
+	if err != nil {
+		panic(err)
+	}
+}
+
+//--------------------------------- Iterator ------------------------------------------------------
+//
+// The following methods may only be used on iterators of DupSort buckets.
+
+// Position at the next value of the current key. If current position is the last value of the
+// key, NextDup() returns false, and stays its current position.
+func (itr *Iterator) TryNextDup() (bool, error) {
+	return itr.state().move(mdb.NEXT_DUP)
+}
+
+func (itr *Iterator) NextDup() bool {
+	ok, err := itr.TryNextDup()
+	if err != nil {
+		panic(err)
+	}
+	return ok
+}
+
+// Position at the previous value of the current key. If current position is the first value of
+// the key, PrevDup() returns false, and stays its current position.
+func (itr *Iterator) TryPrevDup() (bool, error) {
+	return itr.state().move(mdb.PREV_DUP)
+}
+
+func (itr *Iterator) PrevDup() bool {
+	ok, err := itr.TryPrevDup()
+	if err != nil {
+		panic(err)
+	}
+	return ok
+}
+
+// Position at the first value of the next key.
+func (itr *Iterator) TryNextNoDup() (bool, error) {
+	return itr.state().move(mdb.NEXT_NODUP)
+}
+
+func (itr *Iterator) NextNoDup() bool {
+	ok, err := itr.TryNextNoDup()
+	if err != nil {
+		panic(err)
+	}
+	return ok
+}
+
+// Position at the last value of the previous key.
+func (itr *Iterator) TryPrevNoDup() (bool, error) {
+	return itr.state().move(mdb.PREV_NODUP)
+}
+
+func (itr *Iterator) PrevNoDup() bool {
+	ok, err := itr.TryPrevNoDup()
+	if err != nil {
+		panic(err)
+	}
+	return ok
+}
+
+// Position at the first value of the current key.
+func (itr *Iterator) TryFirstDup() (bool, error) {
+	return itr.state().move(mdb.FIRST_DUP)
+}
+
+func (itr *Iterator) FirstDup() bool {
+	ok, err := itr.TryFirstDup()
+	if err != nil {
+		panic(err)
+	}
+	return ok
+}
+
+// Position at the last value of the current key.
+func (itr *Iterator) TryLastDup() (bool, error) {
+	return itr.state().move(mdb.LAST_DUP)
+}
+
+func (itr *Iterator) LastDup() bool {
+	ok, err := itr.TryLastDup()
+	if err != nil {
+		panic(err)
+	}
+	return ok
+}
+
+// Position at the pair that matches ({k}, {v}) exactly.
+func (itr *Iterator) TrySeekBoth(k, v []byte) (bool, error) {
+	s := itr.state()
+	err := s.position(k, v, mdb.GET_BOTH)
+	s.recordSeekKey(k, err == nil)
+	if err == mdb.NotFound {
+		return false, nil
+	}
+	return err == nil, wrapError("seek", s.bucket, k, err)
+}
+
+func (itr *Iterator) SeekBoth(k, v []byte) bool {
+	ok, err := itr.TrySeekBoth(k, v)
+	if err != nil {
+		panic(err)
+	}
+	return ok
+}
+
+// Position at the first value greater than or equal to {v} of the key {k}.
+func (itr *Iterator) TrySeekBothGE(k, v []byte) (bool, error) {
+	s := itr.state()
+	err := s.position(k, v, mdb.GET_BOTH_RANGE)
+	s.recordSeekKey(k, err == nil)
+	if err == mdb.NotFound {
+		return false, nil
+	}
+	return err == nil, wrapError("seek", s.bucket, k, err)
+}
+
+func (itr *Iterator) SeekBothGE(k, v []byte) bool {
+	ok, err := itr.TrySeekBothGE(k, v)
+	if err != nil {
+		panic(err)
+	}
+	return ok
+}
+
+// Returns the number of values of the current key.
+func (itr *Iterator) TryCountDups() (uint64, error) {
+	s := itr.state()
+	s.checkOwner()
+	if err := s.checkBucket(); err != nil {
+		return 0, err
+	}
+	var n uint64
+	var err error
+	if s.overlay != nil {
+		n, err = s.overlay.count()
+	} else {
+		n, err = s.cur.Count()
+	}
+	return n, wrapError("count dups", s.bucket, nil, err)
+}
+
+func (itr *Iterator) CountDups() uint64 {
+	n, err := itr.TryCountDups()
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
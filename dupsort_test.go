@@ -0,0 +1,117 @@
+package lmdb
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+const dupBucket string = "dups"
+
+func openDupSortDb(prefix string) (string, *Database) {
+	path, err := ioutil.TempDir("", prefix)
+	if err != nil {
+		panic(err)
+	}
+
+	db, err := Open(path, []string{testBucket, dupBucket}, WithBucketFlags(dupBucket, DupSort))
+	if err != nil {
+		panic(err)
+	}
+	return path, db
+}
+
+func TestDupSort(t *testing.T) {
+	path, db := openDupSortDb("lmdb_test")
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		txn.PutDup(dupBucket, []byte("a"), []byte("3"))
+		txn.PutDup(dupBucket, []byte("a"), []byte("1"))
+		txn.PutDup(dupBucket, []byte("a"), []byte("2"))
+		txn.PutDup(dupBucket, []byte("a"), []byte("2"))
+		txn.PutDup(dupBucket, []byte("b"), []byte("9"))
+		txn.PutDup(dupBucket, []byte("c"), []byte("0"))
+		txn.DeleteDup(dupBucket, []byte("c"), []byte("0"))
+		txn.DeleteDup(dupBucket, []byte("c"), []byte("0"))
+
+		err := txn.TryPutDup(testBucket, []byte("a"), []byte("1"))
+		ensure.True(t, errors.Is(err, ErrNotDupSort))
+		return nil
+	})
+
+	db.TransactionalR(func(txn ReadTxner) {
+		ensure.DeepEqual(t, txn.(DupSortReader).GetAll(dupBucket, []byte("a")),
+			[][]byte{[]byte("1"), []byte("2"), []byte("3")})
+		ensure.DeepEqual(t, txn.(DupSortReader).CountDups(dupBucket, []byte("a")), uint64(3))
+		ensure.DeepEqual(t, txn.(DupSortReader).CountDups(dupBucket, []byte("c")), uint64(0))
+		ensure.True(t, txn.(DupSortReader).GetAll(dupBucket, []byte("c")) == nil)
+
+		itr := txn.Iterate(dupBucket)
+		defer itr.Close()
+		ensure.True(t, itr.NextDup())
+		k, v := itr.Get()
+		ensure.DeepEqual(t, string(k)+string(v), "a2")
+		ensure.True(t, itr.NextNoDup())
+		k, v = itr.Get()
+		ensure.DeepEqual(t, string(k)+string(v), "b9")
+		ensure.False(t, itr.NextDup())
+		ensure.True(t, itr.PrevNoDup())
+		k, v = itr.Get()
+		ensure.DeepEqual(t, string(k)+string(v), "a3")
+
+		ensure.True(t, itr.SeekBoth([]byte("a"), []byte("2")))
+		ensure.DeepEqual(t, itr.CountDups(), uint64(3))
+		ensure.False(t, itr.SeekBoth([]byte("a"), []byte("4")))
+		ensure.True(t, itr.SeekBothGE([]byte("a"), []byte("25")))
+		k, v = itr.Get()
+		ensure.DeepEqual(t, string(k)+string(v), "a3")
+	})
+
+	err := db.CreateBucketWithFlags(dupBucket, 0)
+	ensure.True(t, errors.Is(err, ErrIncompatibleBucket))
+}
+
+func TestDupSortPatch(t *testing.T) {
+	path1, dbTxn := openDupSortDb("dbTxn")
+	defer os.RemoveAll(path1)
+	defer dbTxn.Close()
+
+	path2, dbPatch := openDupSortDb("dbPatch")
+	defer os.RemoveAll(path2)
+	defer dbPatch.Close()
+
+	for _, db := range []*Database{dbTxn, dbPatch} {
+		db.TransactionalRW(func(txn *ReadWriteTxn) error {
+			txn.PutDup(dupBucket, []byte("a"), []byte("1"))
+			txn.PutDup(dupBucket, []byte("a"), []byte("2"))
+			txn.PutDup(dupBucket, []byte("b"), []byte("1"))
+			txn.PutDup(dupBucket, []byte("c"), []byte("1"))
+			return nil
+		})
+	}
+
+	tx := func(txn *ReadWriteTxn) error {
+		txn.PutDup(dupBucket, []byte("a"), []byte("3"))
+		txn.DeleteDup(dupBucket, []byte("a"), []byte("1"))
+		txn.Delete(dupBucket, []byte("b"))
+		txn.TransactionalRW(func(txn *ReadWriteTxn) error {
+			txn.PutDup(dupBucket, []byte("d"), []byte("1"))
+			txn.PutDup(dupBucket, []byte("d"), []byte("0"))
+			return nil
+		})
+		return nil
+	}
+
+	ensure.Nil(t, dbTxn.TransactionalRW(tx))
+	patch, err := MakePatch(dbPatch, tx)
+	ensure.Nil(t, err)
+	ensure.Nil(t, dbPatch.TransactionalRW(func(txn *ReadWriteTxn) error {
+		return txn.ApplyPatch(patch)
+	}))
+	ensure.True(t, IsEqualDb(dbTxn, dbPatch))
+}
@@ -0,0 +1,118 @@
+package lmdb
+
+import (
+	"errors"
+	"fmt"
+
+	mdb "github.com/libreoscar/gomdb"
+)
+
+// Classes of failures. Errors returned (or panicked) by this package can be tested against them
+// with errors.Is, e.g. errors.Is(err, ErrMapFull). Use errors.As with *Error to find out the
+// operation, bucket and key involved.
+var (
+	ErrBucketNotFound     = errors.New("bucket does not exist")
+	ErrMapFull            = errors.New("map is full")                  // MDB_MAP_FULL
+	ErrTxnFull            = errors.New("txn has too many dirty pages") // MDB_TXN_FULL
+	ErrReadersFull        = errors.New("reader slots are used up")     // MDB_READERS_FULL
+	ErrMapResized         = errors.New("map is resized by another process")
+	ErrKeyTooLarge        = errors.New("key or dup value has an unsupported size") // MDB_BAD_VALSIZE
+	ErrCorrupted          = errors.New("database is corrupted")
+	ErrTooManyBuckets     = errors.New("max number of buckets is reached") // MDB_DBS_FULL
+	ErrIncompatibleBucket = errors.New("bucket exists with other flags")   // MDB_INCOMPATIBLE
+	ErrNotDupSort         = errors.New("bucket is not DupSort")
+	ErrEmptyBucketName    = errors.New("bucket name is empty")
+	ErrDropInPatch        = errors.New("buckets can not be dropped while making a patch")
+
+	ErrInvalidOption  = errors.New("invalid option")     // returned by Open
+	ErrCorruptedPatch = errors.New("patch is corrupted") // returned when decoding a TxnPatch
+	ErrNotReversible  = errors.New("patch is not reversible")
+	ErrConflict       = errors.New("keys changed since the patch was made") // see ConflictError
+	ErrTxnFinished    = errors.New("txn is committed or aborted already")   // see handle.go
+)
+
+// Error records a failed operation. {Err} is either one of the ErrXXX above, or the raw error
+// from gomdb, which is still reachable via errors.Is/As (e.g. errors.Is(err, mdb.MapFull)).
+type Error struct {
+	Op     string
+	Bucket string // empty if the operation is not bucket specific
+	Key    []byte // nil if the operation is not key specific
+	Err    error
+}
+
+func (e *Error) Error() string {
+	s := "lmdb: " + e.Op
+	if e.Bucket != "" {
+		s += fmt.Sprintf(" (bucket %q)", e.Bucket)
+	}
+	if e.Key != nil {
+		s += fmt.Sprintf(" (key %x)", e.Key)
+	}
+	return s + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return target != nil && target == errorClass(e.Err)
+}
+
+// Returned by ApplyPatchIfUnchanged: the keys whose state differs from the prior state recorded
+// in the patch, in the order of the patch. Nothing is applied.
+type ConflictError struct {
+	Keys []CellKey
+}
+
+func (e *ConflictError) Error() string {
+	s := fmt.Sprintf("lmdb: apply patch: %v:", ErrConflict)
+	for i, key := range e.Keys {
+		if i == 10 {
+			return s + fmt.Sprintf(" and %d more", len(e.Keys)-i)
+		}
+		s += fmt.Sprintf(" %q/%x", key.Bucket, key.Key)
+	}
+	return s
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// Maps the raw gomdb errors to the classes above, nil if there is no such class.
+func errorClass(err error) error {
+	switch err {
+	case mdb.MapFull:
+		return ErrMapFull
+	case mdb.TxnFull:
+		return ErrTxnFull
+	case mdb.ReadersFull:
+		return ErrReadersFull
+	case mdb.MapResized:
+		return ErrMapResized
+	case mdb.BadValSize:
+		return ErrKeyTooLarge
+	case mdb.Corrupted, mdb.PageNotFound:
+		return ErrCorrupted
+	case mdb.DbsFull:
+		return ErrTooManyBuckets
+	case mdb.Incompatibile:
+		return ErrIncompatibleBucket
+	}
+	return nil
+}
+
+// Returns nil if {err} is nil. {key} is copied, as it may point into the memory map.
+func wrapError(op string, bucket string, key []byte, err error) error {
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	if key != nil {
+		key = append([]byte{}, key...)
+	}
+	return &Error{op, bucket, key, err}
+}
@@ -0,0 +1,67 @@
+package lmdb
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	mdb "github.com/libreoscar/gomdb"
+)
+
+func TestTypedErrors(t *testing.T) {
+	path, err := ioutil.TempDir("", "lmdb_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(path)
+
+	db, err := Open(path, []string{"bucket"})
+	defer db.Close()
+	if err != nil {
+		panic(err)
+	}
+
+	err = db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		return txn.TryPut("non-existing-bucket", []byte("foo"), []byte("bar"))
+	})
+	ensure.True(t, errors.Is(err, ErrBucketNotFound))
+	var lmdbErr *Error
+	ensure.True(t, errors.As(err, &lmdbErr))
+	ensure.DeepEqual(t, lmdbErr.Bucket, "non-existing-bucket")
+
+	tooLargeKey := make([]byte, 4096)
+	err = db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		return txn.TryPut("bucket", tooLargeKey, []byte("bar"))
+	})
+	ensure.True(t, errors.Is(err, ErrKeyTooLarge))
+	ensure.True(t, errors.Is(err, mdb.BadValSize))
+	ensure.False(t, errors.Is(err, ErrMapFull))
+	ensure.True(t, errors.As(err, &lmdbErr))
+	ensure.DeepEqual(t, lmdbErr.Bucket, "bucket")
+	ensure.DeepEqual(t, lmdbErr.Key, tooLargeKey)
+
+	// so do the iterators
+	db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		txn.Put("bucket", []byte("foo"), []byte("bar"))
+		_, err = txn.Iterate("bucket").TrySeekGE(tooLargeKey)
+		return nil
+	})
+	ensure.True(t, errors.Is(err, ErrKeyTooLarge))
+	ensure.True(t, errors.As(err, &lmdbErr))
+	ensure.DeepEqual(t, lmdbErr.Bucket, "bucket")
+
+	// panics carry the same typed errors
+	func() {
+		defer func() {
+			r := recover()
+			e, ok := r.(error)
+			ensure.True(t, ok)
+			ensure.True(t, errors.Is(e, ErrBucketNotFound))
+		}()
+		db.TransactionalR(func(txn ReadTxner) {
+			txn.Get("non-existing-bucket", []byte("foo"))
+		})
+	}()
+}
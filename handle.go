@@ -0,0 +1,151 @@
+package lmdb
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime"
+)
+
+// Explicit txns
+//
+// BeginRead and BeginWrite return txn handles, for code that does not fit in a callback, e.g. an
+// iterator returned to the caller, or a streamed response. A handle must be finished with Commit
+// or Abort, which close its iterators as TransactionalR/TransactionalRW do. Abort is a no-op on a
+// finished handle, so that `defer h.Abort()` is always safe; the other methods panic.
+//
+// Unlike TransactionalRW, a write handle is not run again when the map is full (the map does not
+// grow). BeginWrite locks the goroutine to its thread until the handle is finished, so a write
+// handle must be used, and finished, by the goroutine that began it (see "Thread Safety" in
+// database.go). A handle holds its resources until it is finished: a read handle its snapshot
+// and reader slot, a write handle the writer lock. Map resizes wait for the open handles to be
+// finished (see map_size.go).
+//
+// A handle garbage collected before it is finished is reported in the log, with the call site of
+// BeginRead/BeginWrite if DebugUnfinishedTxns is enabled (see debug.go). It is not finished then:
+// its txn and iterators may still be reachable without the handle, and a write txn can only be
+// finished by its own thread, while the finalizers run on another one. So a leaked handle holds
+// its resources until the Database is closed: a read handle its snapshot and reader slot, a write
+// handle the writer lock, which blocks the other write txns of this process for good. That is
+// why, with DebugUnfinishedTxns, a leaked write handle panics instead.
+
+// A read txn begun by BeginRead, see "Explicit txns" in handle.go.
+type ReadHandle struct {
+	*ReadTxn // nil once finished
+	begun    string
+}
+
+// A write txn begun by BeginWrite, see "Explicit txns" in handle.go.
+type WriteHandle struct {
+	*ReadWriteTxn // nil once finished
+	begun         string
+}
+
+// Errors from beginning the txn are returned.
+func (db *Database) BeginRead() (*ReadHandle, error) {
+	gen := db.bucketGeneration()
+	txn, err := db.beginReadTxn()
+	if err != nil { // Possible Errors: MDB_PANIC, MDB_READERS_FULL, ENOMEM
+		return nil, wrapError("begin read txn", "", nil, err)
+	}
+	db.holdTxn()
+	rdTxn := &ReadTxn{db: db, txn: txn, held: true, bucketGen: gen}
+	h := &ReadHandle{ReadTxn: rdTxn, begun: db.beginSite()}
+	runtime.SetFinalizer(h, (*ReadHandle).leaked)
+	return h, nil
+}
+
+// Errors from beginning the txn are returned. Waits for the other write txns of this process to
+// finish.
+func (db *Database) BeginWrite() (*WriteHandle, error) {
+	if err := db.lockWriter(context.Background()); err != nil {
+		return nil, wrapError("begin txn", "", nil, err)
+	}
+	runtime.LockOSThread() // see "Thread Safety" in database.go
+	txn, _, err := db.beginTxn(0)
+	if err != nil { // Possible Errors: MDB_PANIC, MDB_READERS_FULL, ENOMEM
+		runtime.UnlockOSThread()
+		db.unlockWriter()
+		return nil, wrapError("begin txn", "", nil, err)
+	}
+	db.holdTxn()
+	rwCtx := &ReadWriteTxn{env: db.env, ReadTxn: &ReadTxn{db: db, txn: txn, held: true}}
+	rwCtx.owner = db.txnOwner()
+	rwCtx.bucketChanges = make(map[string]bucketInfo)
+	h := &WriteHandle{ReadWriteTxn: rwCtx, begun: db.beginSite()}
+	runtime.SetFinalizer(h, (*WriteHandle).leaked)
+	return h, nil
+}
+
+// The call site reported for an unfinished handle, empty unless DebugUnfinishedTxns.
+func (db *Database) beginSite() string {
+	if db.debug&DebugUnfinishedTxns == 0 {
+		return ""
+	}
+	return "\nBegun by:\n" + callerStack()
+}
+
+//--------------------------------- ReadHandle ----------------------------------------------------
+
+// Ends the txn. A read txn has nothing to commit, so this is the same as Abort, but
+// ErrTxnFinished is returned if the handle is finished already.
+func (h *ReadHandle) Commit() error {
+	if h.ReadTxn == nil {
+		return wrapError("commit read txn", "", nil, ErrTxnFinished)
+	}
+	h.Abort()
+	return nil
+}
+
+// Ends the txn, closing its iterators. No-op if the handle is finished already.
+func (h *ReadHandle) Abort() {
+	if h.ReadTxn == nil {
+		return
+	}
+	runtime.SetFinalizer(h, nil)
+	txn := h.ReadTxn
+	h.ReadTxn = nil
+	txn.end()
+}
+
+func (h *ReadHandle) leaked() {
+	log.Printf("[ERROR] A read txn handle was never finished, its snapshot is kept.%s", h.begun)
+}
+
+//--------------------------------- WriteHandle ---------------------------------------------------
+
+// Commits the txn, closing its iterators. The txn is finished even if the commit fails.
+// Returns ErrTxnFinished if the handle is finished already.
+func (h *WriteHandle) Commit() error {
+	if h.ReadWriteTxn == nil {
+		return wrapError("commit txn", "", nil, ErrTxnFinished)
+	}
+	return h.finish(true)
+}
+
+// Aborts the txn, closing its iterators. No-op if the handle is finished already.
+func (h *WriteHandle) Abort() {
+	if h.ReadWriteTxn != nil {
+		h.finish(false)
+	}
+}
+
+func (h *WriteHandle) finish(commit bool) error {
+	h.checkOwner()
+	runtime.SetFinalizer(h, nil)
+	txn := h.ReadWriteTxn
+	h.ReadWriteTxn = nil
+	defer txn.db.unlockWriter()
+	defer runtime.UnlockOSThread()
+	defer txn.db.exitHeldTxn()
+	return txn.end(commit)
+}
+
+// Panics with DebugUnfinishedTxns, see "Explicit txns" in handle.go.
+func (h *WriteHandle) leaked() {
+	if h.db.debug&DebugUnfinishedTxns != 0 {
+		panic(fmt.Errorf("lmdb: a write txn handle was never finished, the writer lock is lost.%s",
+			h.begun))
+	}
+	log.Printf("[ERROR] A write txn handle was never finished, the writer lock is lost.%s", h.begun)
+}
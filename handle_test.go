@@ -0,0 +1,160 @@
+package lmdb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestTxnHandles(t *testing.T) {
+	path, db := openDupSortDb("lmdb_test")
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	w, err := db.BeginWrite()
+	ensure.Nil(t, err)
+	w.Put(testBucket, []byte("a"), []byte("1"))
+	ensure.NotNil(t, w.Iterate(testBucket))
+
+	// the writer lock is held by the handle
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = db.TransactionalRWCtx(ctx, func(*ReadWriteTxn) error { return nil })
+	ensure.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	ensure.Nil(t, w.Commit())
+	ensure.True(t, errors.Is(w.Commit(), ErrTxnFinished))
+	w.Abort() // no-op
+
+	// a read handle keeps its snapshot
+	r, err := db.BeginRead()
+	ensure.Nil(t, err)
+	defer r.Abort()
+	itr := r.Iterate(testBucket)
+	ensure.NotNil(t, itr)
+
+	w, err = db.BeginWrite()
+	ensure.Nil(t, err)
+	w.Put(testBucket, []byte("a"), []byte("2"))
+	w.Put(testBucket, []byte("b"), []byte("2"))
+	ensure.Nil(t, w.Commit())
+
+	w, err = db.BeginWrite()
+	ensure.Nil(t, err)
+	w.Put(testBucket, []byte("c"), []byte("3"))
+	w.Abort()
+
+	k, v := itr.Get()
+	ensure.DeepEqual(t, string(k)+string(v), "a1")
+	ensure.False(t, itr.Next())
+	ensure.Nil(t, r.Commit())
+	ensure.True(t, errors.Is(r.Commit(), ErrTxnFinished))
+
+	r, err = db.BeginRead()
+	ensure.Nil(t, err)
+	defer r.Abort()
+	v, _ = r.Get(testBucket, []byte("a"))
+	ensure.DeepEqual(t, v, []byte("2"))
+	_, ok := r.Get(testBucket, []byte("c"))
+	ensure.False(t, ok)
+}
+
+// Unfinished handles are reported when garbage collected, but keep their resources; a write
+// handle panics with DebugUnfinishedTxns.
+func TestTxnHandles_Leak(t *testing.T) {
+	path, err := ioutil.TempDir("", "lmdb_test")
+	ensure.Nil(t, err)
+	defer os.RemoveAll(path)
+	db, err := Open(path, []string{testBucket}, WithDebug(DebugUnfinishedTxns))
+	defer db.Close()
+	ensure.Nil(t, err)
+
+	var mu sync.Mutex
+	var buf bytes.Buffer
+	log.SetOutput(writerFunc(func(p []byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return buf.Write(p)
+	}))
+	defer log.SetOutput(os.Stderr)
+	logged := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return buf.String()
+	}
+	collect := func(msg string) {
+		for i := 0; i < 100 && !strings.Contains(logged(), msg); i++ {
+			runtime.GC()
+			time.Sleep(time.Millisecond)
+		}
+		ensure.True(t, strings.Contains(logged(), msg), logged())
+	}
+
+	// the iterator outlives the handle
+	db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		txn.Put(testBucket, []byte("a"), []byte("1"))
+		return nil
+	})
+	var itr *Iterator
+	func() {
+		r, err := db.BeginRead()
+		ensure.Nil(t, err)
+		itr = r.Iterate(testBucket)
+	}()
+	collect("read txn handle was never finished")
+	ensure.True(t, strings.Contains(logged(), "handle_test.go"), logged())
+	k, v := itr.Get()
+	ensure.DeepEqual(t, string(k)+string(v), "a1")
+	db.txnsMu.Lock()
+	ensure.DeepEqual(t, db.heldTxns, 1)
+	db.txnsMu.Unlock()
+
+	// a write handle panics, as it blocks the other write txns
+	func() {
+		w, err := db.BeginWrite()
+		ensure.Nil(t, err)
+		defer w.Abort()
+		defer func() {
+			e, ok := recover().(error)
+			ensure.True(t, ok)
+			ensure.True(t, strings.Contains(e.Error(), "handle_test.go"), e)
+		}()
+		w.leaked()
+	}()
+
+	// without DebugUnfinishedTxns, it can only be finished by its thread
+	path2, err := ioutil.TempDir("", "lmdb_test")
+	ensure.Nil(t, err)
+	defer os.RemoveAll(path2)
+	db2, err := Open(path2, []string{testBucket})
+	defer db2.Close()
+	ensure.Nil(t, err)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := db2.BeginWrite()
+		ensure.Nil(t, err)
+	}()
+	<-done
+	collect("write txn handle was never finished")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = db2.TransactionalRWCtx(ctx, func(*ReadWriteTxn) error { return nil })
+	ensure.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
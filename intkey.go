@@ -0,0 +1,259 @@
+package lmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"unsafe"
+
+	mdb "github.com/libreoscar/gomdb"
+)
+
+// Integer buckets
+//
+// The keys of a bucket created with IntegerKey (and the values of one created with
+// DupSort|IntegerDup) are native-endian unsigned integers of 4 or 8 bytes, compared numerically.
+// All keys (values) of such a bucket must have the same size, which is the size of its first key
+// (the first value of that key), or any of 4 and 8 bytes while the bucket is empty; keys (values)
+// of other sizes are rejected with ErrKeyTooLarge.
+//
+// The XxxUint64/XxxUint32 methods encode the keys as required; EncodeUint64 etc. are provided for
+// the values of IntegerDup buckets.
+
+// The reads of IntegerKey buckets, implemented by the txns of this package.
+type IntKeyReader interface {
+	GetUint64(bucket string, key uint64) ([]byte, bool)
+	GetUint32(bucket string, key uint32) ([]byte, bool)
+	TryGetUint64(bucket string, key uint64) ([]byte, bool, error)
+	TryGetUint32(bucket string, key uint32) ([]byte, bool, error)
+}
+
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+func EncodeUint64(v uint64) []byte {
+	b := make([]byte, 8)
+	nativeEndian.PutUint64(b, v)
+	return b
+}
+
+func EncodeUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	nativeEndian.PutUint32(b, v)
+	return b
+}
+
+func DecodeUint64(b []byte) (uint64, error) {
+	if len(b) != 8 {
+		return 0, fmt.Errorf("%w: %d bytes for a uint64", ErrKeyTooLarge, len(b))
+	}
+	return nativeEndian.Uint64(b), nil
+}
+
+func DecodeUint32(b []byte) (uint32, error) {
+	if len(b) != 4 {
+		return 0, fmt.Errorf("%w: %d bytes for a uint32", ErrKeyTooLarge, len(b))
+	}
+	return nativeEndian.Uint32(b), nil
+}
+
+func isIntegerSize(b []byte) bool {
+	return len(b) == 4 || len(b) == 8
+}
+
+// The order of IntegerKey (IntegerDup) buckets, in which all keys (values) have the same size.
+func integerCompare(a, b []byte) int {
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+	var x, y uint64
+	if len(a) == 8 {
+		x, y = nativeEndian.Uint64(a), nativeEndian.Uint64(b)
+	} else if len(a) == 4 {
+		x, y = uint64(nativeEndian.Uint32(a)), uint64(nativeEndian.Uint32(b))
+	} else {
+		return bytes.Compare(a, b)
+	}
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// Compares two keys of the bucket in its order.
+func (info bucketInfo) compareKeys(a, b []byte) int {
+	if info.flags&IntegerKey != 0 {
+		return integerCompare(a, b)
+	}
+	return bytes.Compare(a, b)
+}
+
+// Compares two values of a key of the DupSort bucket in its order.
+func (info bucketInfo) compareDups(a, b []byte) int {
+	if info.flags&IntegerDup != 0 {
+		return integerCompare(a, b)
+	}
+	return bytes.Compare(a, b)
+}
+
+// Checks the sizes of {key} and {val} (nil if not applicable) against the flags of {bucket}.
+func (info bucketInfo) checkSizes(op string, bucket string, key, val []byte) error {
+	if info.flags&IntegerKey != 0 && !isIntegerSize(key) {
+		return &Error{op, bucket, key, ErrKeyTooLarge}
+	}
+	if info.flags&IntegerDup != 0 && val != nil && !isIntegerSize(val) {
+		return &Error{op, bucket, key, ErrKeyTooLarge}
+	}
+	return nil
+}
+
+// Checks the sizes of {key} and {val} (nil if not applicable) against those of {first} and
+// {firstVal}, the first key of the integer bucket and its first value (nil if it is empty).
+func (info bucketInfo) checkIntegerSizes(op string, bucket string, key, val, first,
+	firstVal []byte) error {
+
+	if first == nil {
+		return nil
+	}
+	if info.flags&IntegerKey != 0 && len(key) != len(first) ||
+		info.flags&IntegerDup != 0 && val != nil && len(val) != len(firstVal) {
+		return &Error{op, bucket, key, ErrKeyTooLarge}
+	}
+	return nil
+}
+
+// Same as bucketInfo.checkSizes, and checks the sizes of the integer buckets against those of
+// the keys (values) they hold, see "Integer buckets" in intkey.go.
+func (txn *ReadTxn) checkSizes(op string, bucket string, info bucketInfo, key, val []byte) error {
+	err := info.checkSizes(op, bucket, key, val)
+	if err != nil || info.flags&(IntegerKey|IntegerDup) == 0 {
+		return err
+	}
+	cur, err := txn.txn.CursorOpen(info.dbi)
+	if err != nil {
+		return wrapError("open cursor", bucket, nil, err)
+	}
+	defer cur.Close()
+	first, firstVal, err := cur.GetVal(nil, nil, mdb.FIRST)
+	if err == mdb.NotFound {
+		return nil
+	} else if err != nil {
+		return wrapError(op, bucket, key, err)
+	}
+	return info.checkIntegerSizes(op, bucket, key, val, first.BytesNoCopy(),
+		firstVal.BytesNoCopy())
+}
+
+//--------------------------------- ReadTxn -------------------------------------------------------
+
+func (txn *ReadTxn) TryGetUint64(bucket string, key uint64) ([]byte, bool, error) {
+	return txn.TryGet(bucket, EncodeUint64(key))
+}
+
+func (txn *ReadTxn) GetUint64(bucket string, key uint64) ([]byte, bool) {
+	return txn.Get(bucket, EncodeUint64(key))
+}
+
+func (txn *ReadTxn) TryGetUint32(bucket string, key uint32) ([]byte, bool, error) {
+	return txn.TryGet(bucket, EncodeUint32(key))
+}
+
+func (txn *ReadTxn) GetUint32(bucket string, key uint32) ([]byte, bool) {
+	return txn.Get(bucket, EncodeUint32(key))
+}
+
+//--------------------------------- ReadWriteTxn --------------------------------------------------
+
+func (txn *ReadWriteTxn) TryPutUint64(bucket string, key uint64, val []byte) error {
+	return txn.TryPut(bucket, EncodeUint64(key), val)
+}
+
+func (txn *ReadWriteTxn) PutUint64(bucket string, key uint64, val []byte) {
+	txn.Put(bucket, EncodeUint64(key), val)
+}
+
+func (txn *ReadWriteTxn) TryPutUint32(bucket string, key uint32, val []byte) error {
+	return txn.TryPut(bucket, EncodeUint32(key), val)
+}
+
+func (txn *ReadWriteTxn) PutUint32(bucket string, key uint32, val []byte) {
+	txn.Put(bucket, EncodeUint32(key), val)
+}
+
+func (txn *ReadWriteTxn) TryDeleteUint64(bucket string, key uint64) error {
+	return txn.TryDelete(bucket, EncodeUint64(key))
+}
+
+func (txn *ReadWriteTxn) DeleteUint64(bucket string, key uint64) {
+	txn.Delete(bucket, EncodeUint64(key))
+}
+
+func (txn *ReadWriteTxn) TryDeleteUint32(bucket string, key uint32) error {
+	return txn.TryDelete(bucket, EncodeUint32(key))
+}
+
+func (txn *ReadWriteTxn) DeleteUint32(bucket string, key uint32) {
+	txn.Delete(bucket, EncodeUint32(key))
+}
+
+//--------------------------------- Iterator ------------------------------------------------------
+
+func (itr *Iterator) TrySeekGEUint64(k uint64) (bool, error) {
+	return itr.TrySeekGE(EncodeUint64(k))
+}
+
+// Position at first key greater than or equal to {k}.
+func (itr *Iterator) SeekGEUint64(k uint64) bool {
+	return itr.SeekGE(EncodeUint64(k))
+}
+
+func (itr *Iterator) TrySeekGEUint32(k uint32) (bool, error) {
+	return itr.TrySeekGE(EncodeUint32(k))
+}
+
+// Position at first key greater than or equal to {k}.
+func (itr *Iterator) SeekGEUint32(k uint32) bool {
+	return itr.SeekGE(EncodeUint32(k))
+}
+
+// Returns the current key, which must be 8 bytes.
+func (itr *Iterator) TryKeyUint64() (uint64, error) {
+	key, _, err := itr.TryGetNoCopy()
+	if err != nil {
+		return 0, err
+	}
+	return DecodeUint64(key)
+}
+
+func (itr *Iterator) KeyUint64() uint64 {
+	k, err := itr.TryKeyUint64()
+	if err != nil {
+		panic(err)
+	}
+	return k
+}
+
+// Returns the current key, which must be 4 bytes.
+func (itr *Iterator) TryKeyUint32() (uint32, error) {
+	key, _, err := itr.TryGetNoCopy()
+	if err != nil {
+		return 0, err
+	}
+	return DecodeUint32(key)
+}
+
+func (itr *Iterator) KeyUint32() uint32 {
+	k, err := itr.TryKeyUint32()
+	if err != nil {
+		panic(err)
+	}
+	return k
+}
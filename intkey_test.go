@@ -0,0 +1,136 @@
+package lmdb
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestIntegerKey(t *testing.T) {
+	path, err := ioutil.TempDir("", "lmdb_test")
+	ensure.Nil(t, err)
+	defer os.RemoveAll(path)
+
+	const intBucket, intDupBucket = "ints", "intDups"
+	db, err := Open(path, []string{intBucket, intDupBucket},
+		WithBucketFlags(intBucket, IntegerKey),
+		WithBucketFlags(intDupBucket, IntegerKey|DupSort|IntegerDup))
+	defer db.Close()
+	ensure.Nil(t, err)
+
+	db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		// numeric order, unlike the byte order of little-endian keys
+		for _, k := range []uint64{256, 1, 1 << 40, 2} {
+			txn.PutUint64(intBucket, k, []byte{byte(k)})
+		}
+		txn.DeleteUint64(intBucket, 2)
+
+		err := txn.TryPut(intBucket, []byte("abc"), []byte("1"))
+		ensure.True(t, errors.Is(err, ErrKeyTooLarge))
+
+		txn.PutDup(intDupBucket, EncodeUint32(7), EncodeUint32(300))
+		txn.PutDup(intDupBucket, EncodeUint32(7), EncodeUint32(5))
+		err = txn.TryPutDup(intDupBucket, EncodeUint32(7), []byte("x"))
+		ensure.True(t, errors.Is(err, ErrKeyTooLarge))
+		return nil
+	})
+
+	db.TransactionalR(func(txn ReadTxner) {
+		v, exist := txn.(IntKeyReader).GetUint64(intBucket, 256)
+		ensure.True(t, exist)
+		ensure.DeepEqual(t, v, []byte{0})
+		_, exist = txn.(IntKeyReader).GetUint64(intBucket, 2)
+		ensure.False(t, exist)
+
+		itr := txn.Iterate(intBucket)
+		defer itr.Close()
+		var keys []uint64
+		for ok := true; ok; ok = itr.Next() {
+			keys = append(keys, itr.KeyUint64())
+		}
+		ensure.DeepEqual(t, keys, []uint64{1, 256, 1 << 40})
+
+		ensure.True(t, itr.SeekGEUint64(257))
+		ensure.DeepEqual(t, itr.KeyUint64(), uint64(1<<40))
+		ensure.False(t, itr.SeekGEUint64(1<<41))
+
+		_, err := itr.TryKeyUint32()
+		ensure.True(t, errors.Is(err, ErrKeyTooLarge))
+
+		var vals []uint32
+		for _, b := range txn.(DupSortReader).GetAll(intDupBucket, EncodeUint32(7)) {
+			v, err := DecodeUint32(b)
+			ensure.Nil(t, err)
+			vals = append(vals, v)
+		}
+		ensure.DeepEqual(t, vals, []uint32{5, 300})
+	})
+}
+
+func TestIntegerFlags(t *testing.T) {
+	ensure.NotNil(t, IntegerDup.validate())
+	ensure.Nil(t, (DupSort | IntegerDup).validate())
+	ensure.Nil(t, IntegerKey.validate())
+}
+
+func TestIntegerKey_MixedSizes(t *testing.T) {
+	path, err := ioutil.TempDir("", "lmdb_test")
+	ensure.Nil(t, err)
+	defer os.RemoveAll(path)
+
+	const intBucket, intDupBucket = "ints", "intDups"
+	db, err := Open(path, []string{intBucket, intDupBucket},
+		WithBucketFlags(intBucket, IntegerKey),
+		WithBucketFlags(intDupBucket, IntegerKey|DupSort|IntegerDup))
+	defer db.Close()
+	ensure.Nil(t, err)
+
+	db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		// the size is that of the first key
+		txn.PutUint32(intBucket, 1, []byte("a"))
+		err := txn.TryPutUint64(intBucket, 2, []byte("b"))
+		ensure.True(t, errors.Is(err, ErrKeyTooLarge))
+		_, _, err = txn.TryGetUint64(intBucket, 1)
+		ensure.True(t, errors.Is(err, ErrKeyTooLarge))
+		txn.PutUint32(intBucket, 2, []byte("b"))
+
+		// and that of its first value
+		txn.PutDup(intDupBucket, EncodeUint64(1), EncodeUint32(1))
+		err = txn.TryPutDup(intDupBucket, EncodeUint64(1), EncodeUint64(2))
+		ensure.True(t, errors.Is(err, ErrKeyTooLarge))
+		err = txn.TryPutDup(intDupBucket, EncodeUint64(2), EncodeUint64(2))
+		ensure.True(t, errors.Is(err, ErrKeyTooLarge))
+		err = txn.TryPutDup(intDupBucket, EncodeUint32(2), EncodeUint32(2))
+		ensure.True(t, errors.Is(err, ErrKeyTooLarge))
+		txn.PutDup(intDupBucket, EncodeUint64(2), EncodeUint32(2))
+		return nil
+	})
+
+	// the same in an overlay txn, whose writes count
+	db.TransactionalR(func(txner ReadTxner) {
+		o := NewOverlayTxn(txner.(*ReadTxn))
+		err := o.TryPutUint64(intBucket, 3, []byte("c"))
+		ensure.True(t, errors.Is(err, ErrKeyTooLarge))
+
+		o.ClearBucket(intBucket)
+		o.PutUint64(intBucket, 3, []byte("c"))
+		err = o.TryPutUint32(intBucket, 4, []byte("d"))
+		ensure.True(t, errors.Is(err, ErrKeyTooLarge))
+	})
+
+	// any size once the bucket is empty
+	db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		txn.DeleteUint32(intBucket, 1)
+		txn.DeleteUint32(intBucket, 2)
+		txn.PutUint64(intBucket, 3, []byte("c"))
+		return nil
+	})
+	db.TransactionalR(func(txn ReadTxner) {
+		v, exist := txn.(IntKeyReader).GetUint64(intBucket, 3)
+		ensure.True(t, exist)
+		ensure.DeepEqual(t, v, []byte("c"))
+	})
+}
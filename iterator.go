@@ -2,6 +2,8 @@ package lmdb
 
 import (
 	"bytes"
+	"sync"
+
 	mdb "github.com/libreoscar/gomdb"
 )
 
@@ -11,87 +13,282 @@ import (
 //
 // Attention:
 // The bytes returned from GetNoCopy() are memory-mapped database contents, DO NOT modify them.
+//
+// Methods panic on unexpected LMDB errors; each of them has a Try* counterpart which returns the
+// error instead.
+//
+// An *Iterator converts to and from the *mdb.Cursor it is made of.
 type Iterator mdb.Cursor
 
+// The state of an iterator besides its cursor. It is kept in iterStates, keyed by the cursor, so
+// that *Iterator and *mdb.Cursor stay convertible both ways; a cursor converted by the caller has
+// no state.
+type iterState struct {
+	cur *mdb.Cursor
+	// Txns tracking their reads only, see read_set.go
+	reads  *readSet
+	bucket string
+	span   int // index in reads.ranges of the range covering the position, -1 if none
+	// Overlay txns only, see overlay.go
+	overlay *overlayCursor
+	// The goroutine running the write txn of the iterator if DebugTxnGoroutine, see debug.go
+	owner int64
+	// The txn tracking the NoCopy results, nil for internal iterators. See nocopy.go.
+	txn *ReadTxn
+	// Read txns only: the DBI of the bucket, and the last Database.bucketGen it was checked
+	// against. See checkBucket.
+	dbi mdb.DBI
+	gen uint64
+}
+
+var iterStates sync.Map // *mdb.Cursor -> *iterState, until the iterator is closed
+
+func newIterator(cur *mdb.Cursor, state iterState) *Iterator {
+	state.cur, state.span = cur, -1
+	iterStates.Store(cur, &state)
+	return (*Iterator)(cur)
+}
+
+func (itr *Iterator) state() *iterState {
+	if state, ok := iterStates.Load((*mdb.Cursor)(itr)); ok {
+		return state.(*iterState)
+	}
+	return &iterState{cur: (*mdb.Cursor)(itr), span: -1}
+}
+
 func (itr *Iterator) Close() {
+	itr.state().checkOwner()
+	iterStates.Delete((*mdb.Cursor)(itr))
 	(*mdb.Cursor)(itr).Close() // Possible errors: Iterator already closed (ignored)
 }
 
-func (itr *Iterator) SeekFirst() bool {
-	_, _, err := (*mdb.Cursor)(itr).GetVal(nil, nil, mdb.FIRST)
+// Fails with ErrBucketNotFound once the bucket of an iterator of a read txn is dropped, see
+// "Buckets" in buckets.go.
+func (itr *iterState) checkBucket() error {
+	if itr.txn == nil || itr.txn.bucketChanges != nil {
+		return nil
+	}
+	gen := itr.txn.db.bucketGeneration()
+	if gen == itr.gen {
+		return nil
+	}
+	if info, err := itr.txn.bucketInfo(itr.bucket); err != nil || info.dbi != itr.dbi {
+		return &Error{"open bucket", itr.bucket, nil, ErrBucketNotFound}
+	}
+	itr.gen = gen
+	return nil
+}
+
+// Generic cursor movement for ops that need no key. Returns false if there is no such position.
+func (itr *iterState) move(op uint) (bool, error) {
+	var prev []byte
+	if itr.reads != nil {
+		prev = itr.currentKey()
+	}
+	err := itr.position(nil, nil, op)
 	if err != nil && err != mdb.NotFound {
+		return false, wrapError("move cursor", itr.bucket, nil, err)
+	}
+
+	ok := err == nil
+	switch op {
+	case mdb.FIRST:
+		itr.recordSeek(nil, ok, false)
+	case mdb.LAST:
+		itr.recordSeek(nil, ok, true)
+	case mdb.NEXT, mdb.NEXT_NODUP:
+		itr.recordStep(prev, ok, false)
+	case mdb.PREV, mdb.PREV_NODUP:
+		itr.recordStep(prev, ok, true)
+	}
+	return ok, nil
+}
+
+// Moves the cursor with {op}, which may need a key and a value.
+func (itr *iterState) position(k, v []byte, op uint) error {
+	itr.checkOwner()
+	if err := itr.checkBucket(); err != nil {
+		return err
+	}
+	if itr.overlay != nil {
+		_, _, err := itr.overlay.get(k, v, op)
+		return err
+	}
+	_, _, err := itr.cur.GetVal(k, v, op)
+	return err
+}
+
+// Positions at the first key >= {k}, and returns that key.
+func (itr *iterState) seekRange(k []byte) ([]byte, bool, error) {
+	itr.checkOwner()
+	if err := itr.checkBucket(); err != nil {
+		return nil, false, err
+	}
+	var key []byte
+	var err error
+	if itr.overlay != nil {
+		key, _, err = itr.overlay.get(k, nil, mdb.SET_RANGE)
+	} else {
+		var v mdb.Val
+		v, _, err = itr.cur.GetVal(k, nil, mdb.SET_RANGE)
+		key = v.BytesNoCopy()
+	}
+	if err == mdb.NotFound {
+		itr.recordSeek(k, false, false)
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, wrapError("seek", itr.bucket, k, err)
+	}
+	itr.recordSeek(k, true, false)
+	return key, true, nil
+}
+
+func (itr *Iterator) TrySeekFirst() (bool, error) {
+	return itr.state().move(mdb.FIRST)
+}
+
+func (itr *Iterator) SeekFirst() bool {
+	ok, err := itr.TrySeekFirst()
+	if err != nil {
 		panic(err)
 	}
-	return err == nil
+	return ok
+}
+
+func (itr *Iterator) TrySeekLast() (bool, error) {
+	return itr.state().move(mdb.LAST)
 }
 
 func (itr *Iterator) SeekLast() bool {
-	_, _, err := (*mdb.Cursor)(itr).GetVal(nil, nil, mdb.LAST)
-	if err != nil && err != mdb.NotFound {
+	ok, err := itr.TrySeekLast()
+	if err != nil {
 		panic(err)
 	}
-	return err == nil
+	return ok
+}
+
+func (itr *Iterator) TryPrev() (bool, error) {
+	return itr.state().move(mdb.PREV)
 }
 
 // If current position is the first element, Prev() returns false, and stays its current position.
 func (itr *Iterator) Prev() bool {
-	_, _, err := (*mdb.Cursor)(itr).GetVal(nil, nil, mdb.PREV)
-	if err != nil && err != mdb.NotFound {
+	ok, err := itr.TryPrev()
+	if err != nil {
 		panic(err)
 	}
-	return err == nil
+	return ok
+}
+
+func (itr *Iterator) TryNext() (bool, error) {
+	return itr.state().move(mdb.NEXT)
 }
 
 // If current position is the last element, Next() returns false, and stays its current position.
 func (itr *Iterator) Next() bool {
-	_, _, err := (*mdb.Cursor)(itr).GetVal(nil, nil, mdb.NEXT)
-	if err != nil && err != mdb.NotFound {
+	ok, err := itr.TryNext()
+	if err != nil {
 		panic(err)
 	}
-	return err == nil
+	return ok
+}
+
+func (itr *Iterator) TrySeekExact(k []byte) (bool, error) {
+	key, ok, err := itr.state().seekRange(k)
+	return ok && bytes.Equal(key, k), err
 }
 
 // Position at the key that matches {k} exactly
 func (itr *Iterator) SeekExact(k []byte) bool {
-	key, _, err := (*mdb.Cursor)(itr).GetVal(k, nil, mdb.SET_RANGE)
-	if err != nil && err != mdb.NotFound {
+	ok, err := itr.TrySeekExact(k)
+	if err != nil {
 		panic(err)
 	}
-	return err == nil && bytes.Equal(key.BytesNoCopy(), k)
+	return ok
+}
+
+func (itr *Iterator) TrySeekGE(k []byte) (bool, error) {
+	_, ok, err := itr.state().seekRange(k)
+	return ok, err
 }
 
 // Position at first key greater than or equal to specified key.
 func (itr *Iterator) SeekGE(k []byte) bool {
-	_, _, err := (*mdb.Cursor)(itr).GetVal(k, nil, mdb.SET_RANGE)
-	if err != nil && err != mdb.NotFound {
+	ok, err := itr.TrySeekGE(k)
+	if err != nil {
 		panic(err)
 	}
-	return err == nil
+	return ok
+}
+
+func (itr *Iterator) TrySeekByPrefix(prefix []byte) (bool, error) {
+	key, ok, err := itr.state().seekRange(prefix)
+	return ok && bytes.HasPrefix(key, prefix), err
 }
 
 // Position at first key that has the specified prefix
 func (itr *Iterator) SeekByPrefix(prefix []byte) bool {
-	key, _, err := (*mdb.Cursor)(itr).GetVal(prefix, nil, mdb.SET_RANGE)
-	if err != nil && err != mdb.NotFound {
+	ok, err := itr.TrySeekByPrefix(prefix)
+	if err != nil {
 		panic(err)
 	}
-	return err == nil && bytes.HasPrefix(key.BytesNoCopy(), prefix)
+	return ok
+}
+
+func (itr *Iterator) TryGet() ([]byte, []byte, error) {
+	s := itr.state()
+	s.checkOwner()
+	if err := s.checkBucket(); err != nil {
+		return nil, nil, err
+	}
+	if s.overlay != nil {
+		key, val, err := s.overlay.get(nil, nil, mdb.GET_CURRENT)
+		if err != nil {
+			return nil, nil, wrapError("get current", s.bucket, nil, err)
+		}
+		return append([]byte(nil), key...), append([]byte(nil), val...), nil
+	}
+	key, val, err := s.cur.GetVal(nil, nil, mdb.GET_CURRENT)
+	if err != nil {
+		return nil, nil, wrapError("get current", s.bucket, nil, err)
+	}
+	return key.Bytes(), val.Bytes(), nil
 }
 
 // Returns (key, value) pair.
 func (itr *Iterator) Get() ([]byte, []byte) {
-	key, val, err := (*mdb.Cursor)(itr).GetVal(nil, nil, mdb.GET_CURRENT)
+	key, val, err := itr.TryGet()
 	if err != nil {
 		panic(err)
 	}
-	return key.Bytes(), val.Bytes()
+	return key, val
+}
+
+func (itr *Iterator) TryGetNoCopy() ([]byte, []byte, error) {
+	s := itr.state()
+	s.checkOwner()
+	if err := s.checkBucket(); err != nil {
+		return nil, nil, err
+	}
+	if s.overlay != nil {
+		key, val, err := s.overlay.get(nil, nil, mdb.GET_CURRENT)
+		if err != nil {
+			return nil, nil, wrapError("get current", s.bucket, nil, err)
+		}
+		return s.txn.trackNoCopy(key), s.txn.trackNoCopy(val), nil
+	}
+	key, val, err := s.cur.GetVal(nil, nil, mdb.GET_CURRENT)
+	if err != nil {
+		return nil, nil, wrapError("get current", s.bucket, nil, err)
+	}
+	return s.txn.trackNoCopy(key.BytesNoCopy()), s.txn.trackNoCopy(val.BytesNoCopy()), nil
 }
 
 // Returns (key, value) pair. DO NOT modify them in-place, make a copy instead.
 func (itr *Iterator) GetNoCopy() ([]byte, []byte) {
-	key, val, err := (*mdb.Cursor)(itr).GetVal(nil, nil, mdb.GET_CURRENT)
+	key, val, err := itr.TryGetNoCopy()
 	if err != nil {
 		panic(err)
 	}
-	return key.BytesNoCopy(), val.BytesNoCopy()
+	return key, val
 }
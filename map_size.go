@@ -0,0 +1,174 @@
+package lmdb
+
+import (
+	"log"
+	"time"
+
+	mdb "github.com/libreoscar/gomdb"
+)
+
+// Map size management
+//
+// mdb_env_set_mapsize may only be called when no txn is active in this process, so every
+// top-level txn is registered in Database.activeTxns (Database.heldTxns for the long-lived ones,
+// see handle.go and snapshot.go), and a resize waits for them all to finish. New txns wait for a
+// pending resize, so that the resize is not delayed by txns that keep overlapping. A snapshot
+// lets a pending resize go first when it is refreshed, as its txn is reset in between.
+//
+// A resize waits for the txns for resizeWait at most, then gives up: growing the map fails with
+// ErrMapFull, adopting the size set by another process with ErrMapResized. So a goroutine that
+// hits MDB_MAP_FULL (or MDB_MAP_RESIZED) while it holds another txn itself, e.g. TransactionalRW
+// called inside TransactionalR, fails rather than waiting for itself forever, and the txns begun
+// meanwhile by the other goroutines are delayed by resizeWait. The same goes for a txn handle or a
+// snapshot held open for longer than resizeWait.
+
+// How long a resize waits for the active txns to finish, see "Map size management".
+const resizeWaitDefault = 5 * time.Second
+
+// Let the map grow by {step} bytes, up to {ceiling}, whenever a TransactionalRW fails with
+// ErrMapFull. The failed txn is aborted, the map is grown once no txn is active, and the txn
+// callback is run again, so it must not have side effects outside of the txn.
+// {step} == 0 disables growth, which is the default.
+func (db *Database) SetMapGrowth(step, ceiling uint64) {
+	db.txnsMu.Lock()
+	defer db.txnsMu.Unlock()
+	db.growthStep = step
+	db.maxMapSize = ceiling
+}
+
+// Begins a top-level txn, registered in activeTxns, adopting the new map size if another process
+// has grown it. Returns the map size at the time the txn began.
+func (db *Database) beginTxn(flags uint) (*mdb.Txn, uint64, error) {
+	for {
+		txn, mapSize, err := db.tryBeginTxn(flags)
+		if err != mdb.MapResized {
+			return txn, mapSize, err
+		}
+		if err = db.adoptMapSize(); err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
+// Same as beginTxn, but returns mdb.MapResized rather than adopting the new map size, which waits
+// for the other txns to finish.
+func (db *Database) tryBeginTxn(flags uint) (*mdb.Txn, uint64, error) {
+	mapSize := db.enterTxn()
+	txn, err := db.env.BeginTxn(nil, flags)
+	if err != nil {
+		db.exitTxn()
+		return nil, 0, err
+	}
+	return txn, mapSize, nil
+}
+
+// Registers a txn about to begin (or be renewed) in activeTxns, once no resize is pending.
+// Returns the map size.
+func (db *Database) enterTxn() uint64 {
+	db.txnsMu.Lock()
+	defer db.txnsMu.Unlock()
+	for db.resizing > 0 {
+		db.txnsDone.Wait()
+	}
+	db.activeTxns++
+	return db.mapSize
+}
+
+func (db *Database) exitTxn() {
+	db.txnsMu.Lock()
+	db.activeTxns--
+	if db.activeTxns == 0 && db.heldTxns == 0 {
+		db.txnsDone.Broadcast()
+	}
+	db.txnsMu.Unlock()
+}
+
+// Moves a txn registered by enterTxn to heldTxns, as it is long-lived.
+func (db *Database) holdTxn() {
+	db.txnsMu.Lock()
+	db.heldTxns++
+	db.txnsMu.Unlock()
+	db.exitTxn()
+}
+
+// Unregisters a txn moved to heldTxns by holdTxn.
+func (db *Database) exitHeldTxn() {
+	db.txnsMu.Lock()
+	db.heldTxns--
+	if db.activeTxns == 0 && db.heldTxns == 0 {
+		db.txnsDone.Broadcast()
+	}
+	db.txnsMu.Unlock()
+}
+
+// Waits for the txns to finish, for resizeWait at most, while the new txns wait. Returns false if
+// they did not. Must be called with txnsMu held.
+func (db *Database) waitForTxns() bool {
+	if db.activeTxns > 0 || db.heldTxns > 0 {
+		db.resizing++
+		deadline := time.Now().Add(db.resizeWait)
+		timer := time.AfterFunc(db.resizeWait, func() {
+			db.txnsMu.Lock()
+			db.txnsDone.Broadcast()
+			db.txnsMu.Unlock()
+		})
+		for (db.activeTxns > 0 || db.heldTxns > 0) && time.Now().Before(deadline) {
+			db.txnsDone.Wait()
+		}
+		timer.Stop()
+		db.resizing--
+		db.txnsDone.Broadcast() // the new txns still wait for txnsMu, until the resize is done
+	}
+	return db.activeTxns == 0 && db.heldTxns == 0
+}
+
+// Called when a txn begun with map size {mapSize} failed with MDB_MAP_FULL.
+// Returns whether the map is larger than {mapSize} now, i.e. the txn is worth retrying.
+func (db *Database) growMap(mapSize uint64) bool {
+	db.txnsMu.Lock()
+	defer db.txnsMu.Unlock()
+
+	if db.growthStep == 0 {
+		return false
+	}
+	if !db.waitForTxns() {
+		log.Printf("[ERROR] Growing map failed. Other txns are still open.")
+		return false
+	}
+	if db.mapSize > mapSize { // grown by someone else in the meantime
+		return true
+	}
+	if db.mapSize >= db.maxMapSize {
+		return false
+	}
+
+	newSize := db.mapSize + db.growthStep
+	if newSize > db.maxMapSize || newSize < db.mapSize {
+		newSize = db.maxMapSize
+	}
+	if err := db.env.SetMapSize(newSize); err != nil {
+		log.Printf("[ERROR] Growing map to %d bytes failed. %v", newSize, err)
+		return false
+	}
+	db.mapSize = newSize
+	return true
+}
+
+// Adopts the map size set by another process (MDB_MAP_RESIZED).
+func (db *Database) adoptMapSize() error {
+	db.txnsMu.Lock()
+	defer db.txnsMu.Unlock()
+
+	if !db.waitForTxns() {
+		return mdb.MapResized
+	}
+	if err := db.env.SetMapSize(0); err != nil {
+		return err
+	}
+	info, err := db.env.Info()
+	if err != nil {
+		return err
+	}
+	db.mapSize = info.MapSize
+	return nil
+}
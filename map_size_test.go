@@ -0,0 +1,168 @@
+package lmdb
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+func fillBucket(txn *ReadWriteTxn, n int) {
+	val := make([]byte, 1024)
+	for i := 0; i < n; i++ {
+		txn.Put(testBucket, []byte(fmt.Sprintf("key%08d", i)), val)
+	}
+}
+
+func tryFillBucket(txn *ReadWriteTxn, n int) error {
+	val := make([]byte, 1024)
+	for i := 0; i < n; i++ {
+		if err := txn.TryPut(testBucket, []byte(fmt.Sprintf("key%08d", i)), val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestMapGrowth(t *testing.T) {
+	path, err := ioutil.TempDir("", "lmdb_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(path)
+
+	db, err := Open2(path, []string{testBucket}, 1<<20, MAX_DB_DEFAULT)
+	defer db.Close()
+	if err != nil {
+		panic(err)
+	}
+
+	// without growth
+	err = db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		return tryFillBucket(txn, 4096)
+	})
+	ensure.True(t, errors.Is(err, ErrMapFull))
+	func() {
+		defer func() {
+			r := recover()
+			e, ok := r.(error)
+			ensure.True(t, ok)
+			ensure.True(t, errors.Is(e, ErrMapFull))
+		}()
+		db.TransactionalRW(func(txn *ReadWriteTxn) error {
+			fillBucket(txn, 4096)
+			return nil
+		})
+	}()
+
+	// with growth
+	db.SetMapGrowth(1<<20, 8<<20)
+	runs := 0
+	err = db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		runs++
+		fillBucket(txn, 4096)
+		return nil
+	})
+	ensure.Nil(t, err)
+	ensure.True(t, runs > 1)
+	ensure.True(t, db.Info().MapSize > 1<<20)
+	db.TransactionalR(func(txn ReadTxner) {
+		ensure.DeepEqual(t, txn.BucketStat(testBucket).Entries, uint64(4096))
+	})
+
+	// the ceiling is respected
+	err = db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		return tryFillBucket(txn, 16384)
+	})
+	ensure.True(t, errors.Is(err, ErrMapFull))
+	ensure.DeepEqual(t, db.Info().MapSize, uint64(8<<20))
+}
+
+// Waits for a resize to wait for the txns.
+func waitForResize(db *Database) {
+	for {
+		db.txnsMu.Lock()
+		resizing := db.resizing > 0
+		db.txnsMu.Unlock()
+		if resizing {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// A resize waits for the txns of its own goroutine and for the long-lived txns in vain, but not
+// for those finished meanwhile, and the new txns wait for it.
+func TestMapGrowth_OpenTxns(t *testing.T) {
+	path, err := ioutil.TempDir("", "lmdb_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(path)
+
+	db, err := Open2(path, []string{testBucket}, 1<<20, MAX_DB_DEFAULT)
+	defer db.Close()
+	if err != nil {
+		panic(err)
+	}
+	db.SetMapGrowth(1<<20, 16<<20)
+	fill := func(n int) func(txn *ReadWriteTxn) error {
+		return func(txn *ReadWriteTxn) error {
+			return tryFillBucket(txn, n)
+		}
+	}
+
+	// the read txn of the goroutine is waited for resizeWait, in vain
+	db.resizeWait = 10 * time.Millisecond
+	db.TransactionalR(func(ReadTxner) {
+		ensure.True(t, errors.Is(db.TransactionalRW(fill(4096)), ErrMapFull))
+	})
+	ensure.DeepEqual(t, db.Info().MapSize, uint64(1<<20))
+
+	// so is a snapshot held open
+	s, err := db.Snapshot()
+	ensure.Nil(t, err)
+	ensure.True(t, errors.Is(db.TransactionalRW(fill(4096)), ErrMapFull))
+	ensure.DeepEqual(t, db.Info().MapSize, uint64(1<<20))
+
+	// a handle finished meanwhile is not, and the txns begun meanwhile wait
+	db.resizeWait = time.Hour
+	s.Close()
+	h, err := db.BeginRead()
+	ensure.Nil(t, err)
+	done := make(chan error)
+	go func() { done <- db.TransactionalRW(fill(4096)) }()
+	waitForResize(db)
+	began := make(chan struct{})
+	go func() {
+		db.TransactionalR(func(ReadTxner) {})
+		close(began)
+	}()
+	select {
+	case <-began:
+		t.Fatal("a txn began during a resize")
+	case <-time.After(10 * time.Millisecond):
+	}
+	h.Abort()
+	ensure.Nil(t, <-done)
+	<-began
+	ensure.True(t, db.Info().MapSize > 1<<20)
+
+	// nor is a snapshot refreshed meanwhile (then held again, so the map must grow at once)
+	mapSize := db.Info().MapSize
+	db.SetMapGrowth(8<<20, 16<<20)
+	s, err = db.Snapshot()
+	ensure.Nil(t, err)
+	defer s.Close()
+	go func() { done <- db.TransactionalRW(fill(8192)) }()
+	waitForResize(db)
+	ensure.Nil(t, s.Refresh())
+	ensure.Nil(t, <-done)
+	ensure.True(t, db.Info().MapSize > mapSize)
+	ensure.Nil(t, s.Refresh())
+	ensure.DeepEqual(t, s.BucketStat(testBucket).Entries, uint64(8192))
+}
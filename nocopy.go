@@ -0,0 +1,129 @@
+package lmdb
+
+import (
+	"bytes"
+	"log"
+	"sync"
+	"unsafe"
+)
+
+// Checked NoCopy results
+//
+// The slices returned by GetNoCopy and Iterator.GetNoCopy point into the memory map: they must
+// not be modified, nor used after the txn ends. With DebugNoCopy (see debug.go), they are copies
+// instead, each in pages of its own (see mapCopy), tracked by the txn along with a pristine copy
+// and the call site. When the txn ends (a nested txn included), a copy that differs from the
+// pristine one is reported in the log as modified in place, then its pages are protected
+// (mprotect PROT_NONE), so that any later read or write faults at the use site. The call site
+// that returned the copy is then found with Database.NoCopySite, from the address of the fault
+// (see debug.SetPanicOnFault).
+//
+// The protected copies are unmapped once there are more than maxProtected of them, the oldest
+// first, and by Close; a later use of an unmapped copy faults as well, unless its address was
+// mapped again since. On platforms without mprotect (e.g. Windows), the copies are on the heap
+// and uses after the txn are not detected. Neither is a use after a subsequent write in the same
+// txn, which invalidates the results of a write txn as well.
+
+const maxProtected = 4096 // a page each at least
+
+// A NoCopy result of a txn, tracked with DebugNoCopy.
+type trackedCopy struct {
+	buf  []byte // returned to the caller, at the start of {mem}
+	mem  []byte // the pages of {buf}, nil if they could not be mapped
+	orig []byte
+	site string
+}
+
+// The protected copies of the txns that ended, oldest first.
+type protectedCopies struct {
+	mu     sync.Mutex
+	copies []trackedCopy
+}
+
+// Returns a tracked copy of {b}, a NoCopy result of {txn}, with DebugNoCopy. Otherwise returns
+// {b}, as it does if {txn} is nil (an internal iterator).
+func (txn *ReadTxn) trackNoCopy(b []byte) []byte {
+	if txn == nil || txn.db.debug&DebugNoCopy == 0 || len(b) == 0 {
+		return b
+	}
+	c := trackedCopy{orig: append([]byte(nil), b...), site: "\nReturned by:\n" + callerStack()}
+	mem, err := mapCopy(len(b))
+	if err != nil {
+		log.Printf("[ERROR] Mapping a NoCopy result failed, it is not protected. %v", err)
+	}
+	if mem != nil {
+		c.mem, c.buf = mem, mem[:len(b):len(b)]
+	} else {
+		c.buf = make([]byte, len(b))
+	}
+	copy(c.buf, b)
+	txn.noCopies = append(txn.noCopies, c)
+	return c.buf
+}
+
+// Checks and protects the NoCopy results of {txn}, which is ending. See "Checked NoCopy results"
+// in nocopy.go.
+func (txn *ReadTxn) endNoCopies() {
+	if txn.db.debug&DebugNoCopy == 0 {
+		return
+	}
+	for _, c := range txn.noCopies {
+		if !bytes.Equal(c.buf, c.orig) {
+			log.Printf("[ERROR] A NoCopy result was modified in place.%s", c.site)
+		}
+		if c.mem != nil {
+			if err := protectCopy(c.mem); err != nil {
+				log.Printf("[ERROR] Protecting a NoCopy result failed. %v", err)
+			}
+		}
+	}
+	txn.db.protected.add(txn.noCopies)
+	txn.noCopies = nil
+}
+
+// The call site that returned the NoCopy result at {addr}, e.g. the address of a fault, if it is
+// one of the protected results, see "Checked NoCopy results" in nocopy.go.
+func (db *Database) NoCopySite(addr uintptr) (string, bool) {
+	return db.protected.site(addr)
+}
+
+func (p *protectedCopies) add(copies []trackedCopy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.copies = append(p.copies, copies...)
+	if n := len(p.copies) - maxProtected; n > 0 {
+		unmapCopies(p.copies[:n])
+		p.copies = append(p.copies[:0], p.copies[n:]...)
+	}
+}
+
+func (p *protectedCopies) site(addr uintptr) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.copies {
+		if c.mem == nil {
+			continue
+		}
+		start := uintptr(unsafe.Pointer(&c.mem[0]))
+		if start <= addr && addr < start+uintptr(len(c.mem)) {
+			return c.site, true
+		}
+	}
+	return "", false
+}
+
+// Unmaps the protected copies. Called by Close.
+func (p *protectedCopies) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	unmapCopies(p.copies)
+	p.copies = nil
+}
+
+func unmapCopies(copies []trackedCopy) {
+	for _, c := range copies {
+		if c.mem != nil {
+			unmapCopy(c.mem)
+		}
+	}
+}
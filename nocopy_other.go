@@ -0,0 +1,17 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package lmdb
+
+// Without mprotect, the NoCopy results are copied to the heap and not protected, see "Checked
+// NoCopy results" in nocopy.go.
+func mapCopy(n int) ([]byte, error) {
+	return nil, nil
+}
+
+func protectCopy(mem []byte) error {
+	return nil
+}
+
+func unmapCopy(mem []byte) {
+}
@@ -0,0 +1,87 @@
+package lmdb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+var noCopySink byte // so that reads are not optimized away
+
+// The address of the fault caused by {f}, 0 if there is none.
+func faultAddr(f func()) (addr uintptr) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if e, ok := recover().(interface{ Addr() uintptr }); ok {
+			addr = e.Addr()
+		}
+	}()
+	f()
+	return 0
+}
+
+func TestDebugNoCopy(t *testing.T) {
+	path, err := ioutil.TempDir("", "lmdb_test")
+	ensure.Nil(t, err)
+	defer os.RemoveAll(path)
+	db, err := Open(path, []string{testBucket}, WithDebug(DebugNoCopy))
+	ensure.Nil(t, err)
+	defer db.Close()
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	logged := func() string {
+		s := buf.String()
+		buf.Reset()
+		return s
+	}
+
+	var kept, nested []byte
+	ensure.Nil(t, db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		txn.Put(testBucket, []byte("a"), []byte("1"))
+		txn.Put(testBucket, []byte("b"), []byte("2"))
+		_, kept = txn.Iterate(testBucket).GetNoCopy()
+		ensure.DeepEqual(t, kept, []byte("1"))
+		return txn.TransactionalRW(func(txn *ReadWriteTxn) error {
+			nested, _ = txn.GetNoCopy(testBucket, []byte("b"))
+			return nil
+		})
+	}))
+	ensure.DeepEqual(t, logged(), "")
+
+	// modified in place
+	db.TransactionalR(func(txn ReadTxner) {
+		v, _ := txn.GetNoCopy(testBucket, []byte("a"))
+		v[0] = 'x'
+	})
+	s := logged()
+	ensure.True(t, strings.Contains(s, "modified in place"), s)
+	ensure.True(t, strings.Contains(s, "nocopy_test.go"), s)
+	db.TransactionalR(func(txn ReadTxner) {
+		v, _ := txn.Get(testBucket, []byte("a"))
+		ensure.DeepEqual(t, v, []byte("1")) // the database is untouched
+	})
+
+	if runtime.GOOS == "windows" {
+		return // not protected
+	}
+
+	// used after the txn: read, then written
+	for _, use := range []func(){func() { noCopySink = kept[0] }, func() { nested[0] = 'x' }} {
+		addr := faultAddr(use)
+		ensure.True(t, addr != 0)
+		site, ok := db.NoCopySite(addr)
+		ensure.True(t, ok)
+		ensure.True(t, strings.Contains(site, "nocopy_test.go"), site)
+	}
+	_, ok := db.NoCopySite(uintptr(1))
+	ensure.False(t, ok)
+}
@@ -0,0 +1,25 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package lmdb
+
+import (
+	"os"
+	"syscall"
+)
+
+// Maps pages of their own for a NoCopy result of {n} bytes, see "Checked NoCopy results" in
+// nocopy.go.
+func mapCopy(n int) ([]byte, error) {
+	size := (n + os.Getpagesize() - 1) &^ (os.Getpagesize() - 1)
+	return syscall.Mmap(-1, 0, size, syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_ANON|syscall.MAP_PRIVATE)
+}
+
+func protectCopy(mem []byte) error {
+	return syscall.Mprotect(mem, syscall.PROT_NONE)
+}
+
+func unmapCopy(mem []byte) {
+	syscall.Munmap(mem) // Possible errors: EINVAL (ignored)
+}
@@ -0,0 +1,212 @@
+package lmdb
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+
+	mdb "github.com/libreoscar/gomdb"
+)
+
+// Optimistic txns
+//
+// RunOptimistic runs txn callbacks concurrently, each in an overlay txn (see overlay.go) on its
+// own read snapshot, recording its reads (see read_set.go). The callbacks are then committed in
+// order in a single TransactionalRW: the changes of a callback are applied if nothing it read has
+// been written since its snapshot, else the callback is run again on the current state. So the
+// result is the same as running the callbacks one after another, in order, each in a nested
+// TransactionalRW, while callbacks touching disjoint keys run in parallel.
+//
+// Whether the data read by a callback has been written is checked against the changes of the
+// callbacks before it. If another txn committed between its snapshot and the TransactionalRW, the
+// callback is run again as well, since its changes are unknown.
+//
+// The callbacks may be run more than once, so they must not have side effects outside of the
+// txn. They may not use the txn after they return, nor from other goroutines.
+
+type optimisticResult struct {
+	done     chan struct{} // closed when the fields below are set
+	snapshot uint64        // id of the last txn committed before the snapshot
+	stale    bool          // the snapshot is unknown, or the callback could not be run
+	patch    TxnPatch
+	reads    *ReadSet
+	panicF   interface{}
+	err      error
+}
+
+// Runs {fs} concurrently, and commits their changes as if they were run in order, see "Optimistic
+// txns" in optimistic.go. Returns the errors returned by {fs} (whose changes are rolled back), and
+// the error of the TransactionalRW, in which case nothing is committed. A panic in a callback
+// aborts the TransactionalRW, and is re-panicked.
+func (db *Database) RunOptimistic(fs ...func(ReadWriteTxner) error) ([]error, error) {
+	results := make([]optimisticResult, len(fs))
+	jobs := make(chan int, len(fs))
+	for i := range fs {
+		results[i].done = make(chan struct{})
+		jobs <- i
+	}
+	close(jobs)
+
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(fs) {
+		workers = len(fs)
+	}
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				db.runSpeculative(fs[i], &results[i])
+			}
+		}()
+	}
+	defer wg.Wait() // the workers use the env until they are done
+
+	errs := make([]error, len(fs))
+	err := db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		base, err := db.lastTxnID()
+		if err != nil {
+			return err
+		}
+
+		written := newWriteSet()
+		for i, f := range fs {
+			res := &results[i]
+			<-res.done
+
+			patch, panicF, err := res.patch, res.panicF, res.err
+			if res.stale || res.snapshot != base || written.conflicts(txn.ReadTxn, res.reads) {
+				patch, _, panicF, err = newOverlayTxn(txn.ReadTxn, false).run(f)
+			}
+			if panicF != nil {
+				panic(panicF)
+			}
+			errs[i] = err
+			if err != nil {
+				continue
+			}
+			if err := txn.ApplyPatch(patch); err != nil {
+				return err
+			}
+			written.add(patch)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
+
+func (db *Database) lastTxnID() (uint64, error) {
+	info, err := db.env.Info()
+	if err != nil {
+		return 0, wrapError("info", "", nil, err)
+	}
+	return info.LastTxnID, nil
+}
+
+// Runs {f} in an overlay txn on a new snapshot, and sets {res}.
+func (db *Database) runSpeculative(f func(ReadWriteTxner) error, res *optimisticResult) {
+	defer close(res.done)
+
+	// the snapshot is known if no txn committed while it was taken
+	before, err := db.lastTxnID()
+	if err != nil {
+		res.stale = true
+		return
+	}
+	// the TransactionalRW may be waiting for this callback, so the map size is left to it
+	gen := db.bucketGeneration()
+	txn, _, err := db.tryBeginTxn(mdb.RDONLY)
+	if err != nil {
+		res.stale = true
+		return
+	}
+	defer db.exitTxn()
+	defer txn.Abort()
+	after, err := db.lastTxnID()
+	res.snapshot, res.stale = after, err != nil || before != after
+
+	snap := &ReadTxn{db: db, txn: txn, bucketGen: gen}
+	defer snap.endNoCopies()
+	res.patch, res.reads, res.panicF, res.err = newOverlayTxn(snap, true).run(f)
+}
+
+//--------------------------------- writeSet ------------------------------------------------------
+
+// The keys written by the callbacks already committed by RunOptimistic.
+type writeSet struct {
+	keys     map[string]struct{} // encoded CellKeys
+	sorted   map[string][][]byte // bucket -> keys, in the order of the bucket unless {unsorted}
+	unsorted map[string]bool
+	cleared  map[string]bool
+}
+
+func newWriteSet() *writeSet {
+	return &writeSet{
+		keys:     make(map[string]struct{}),
+		sorted:   make(map[string][][]byte),
+		unsorted: make(map[string]bool),
+		cleared:  make(map[string]bool),
+	}
+}
+
+func (ws *writeSet) add(patch TxnPatch) {
+	for i := range patch {
+		cell := &patch[i]
+		if cell.IsClear() {
+			ws.cleared[cell.Bucket] = true
+			continue
+		}
+		ck := cell.CellKey().Encode()
+		if _, ok := ws.keys[ck]; !ok {
+			ws.keys[ck] = struct{}{}
+			ws.sorted[cell.Bucket] = append(ws.sorted[cell.Bucket], cell.Key)
+			ws.unsorted[cell.Bucket] = true
+		}
+	}
+}
+
+// Returns whether a key or a range of {reads} has been written. {txn} gives the order of the
+// buckets.
+func (ws *writeSet) conflicts(txn *ReadTxn, reads *ReadSet) bool {
+	for _, ck := range reads.Keys {
+		if _, ok := ws.keys[ck.Encode()]; ok || ws.cleared[ck.Bucket] {
+			return true
+		}
+	}
+	if len(reads.Ranges) == 0 {
+		return false
+	}
+
+	for _, rng := range reads.Ranges {
+		if ws.cleared[rng.Bucket] {
+			return true
+		}
+		keys := ws.sorted[rng.Bucket]
+		if len(keys) == 0 {
+			continue
+		}
+		info, err := txn.bucketInfo(rng.Bucket)
+		if err != nil {
+			return true
+		}
+		if ws.unsorted[rng.Bucket] {
+			sort.Slice(keys, func(i, j int) bool { return info.compareKeys(keys[i], keys[j]) < 0 })
+			ws.unsorted[rng.Bucket] = false
+		}
+
+		i := 0
+		if rng.Start != nil {
+			i = sort.Search(len(keys), func(i int) bool {
+				return info.compareKeys(keys[i], rng.Start) >= 0
+			})
+		}
+		if i < len(keys) && (rng.End == nil || info.compareKeys(keys[i], rng.End) <= 0) {
+			return true
+		}
+	}
+	return false
+}
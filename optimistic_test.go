@@ -0,0 +1,119 @@
+package lmdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestRunOptimistic(t *testing.T) {
+	path, db := openDupSortDb("lmdb_test")
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	// every callback conflicts with the one before it
+	var fs []func(ReadWriteTxner) error
+	for i := 0; i < 30; i++ {
+		i := i
+		fs = append(fs, func(txn ReadWriteTxner) error {
+			v, _ := txn.Get(testBucket, []byte("counter"))
+			n, _ := strconv.Atoi(string(v))
+			txn.Put(testBucket, []byte("counter"), []byte(strconv.Itoa(n+1)))
+			txn.Put(testBucket, []byte(fmt.Sprintf("key%02d", i)), v)
+			if i == 5 {
+				return errors.New("rolled back")
+			}
+			return nil
+		})
+	}
+	errs, err := db.RunOptimistic(fs...)
+	ensure.Nil(t, err)
+	for i, err := range errs {
+		ensure.True(t, (err != nil) == (i == 5))
+	}
+	db.TransactionalR(func(txn ReadTxner) {
+		v, _ := txn.Get(testBucket, []byte("counter"))
+		ensure.DeepEqual(t, string(v), "29")
+		v, _ = txn.Get(testBucket, []byte("key29"))
+		ensure.DeepEqual(t, string(v), "28")
+		_, ok := txn.Get(testBucket, []byte("key05"))
+		ensure.False(t, ok)
+	})
+
+	// a key written in a range read
+	db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		txn.ClearBucket(testBucket)
+		for _, k := range []string{"k1", "k2", "k3"} {
+			txn.Put(testBucket, []byte(k), nil)
+		}
+		return nil
+	})
+	runs := 0
+	errs, err = db.RunOptimistic(
+		func(txn ReadWriteTxner) error {
+			txn.Put(testBucket, []byte("k25"), nil)
+			return nil
+		},
+		func(txn ReadWriteTxner) error {
+			runs++
+			n := 0
+			for itr := txn.Iterate(testBucket); itr != nil && itr.Next(); {
+				n++
+			}
+			txn.Put(dupBucket, []byte("count"), []byte(strconv.Itoa(n+1)))
+			return nil
+		},
+		func(txn ReadWriteTxner) error {
+			txn.Put(dupBucket, []byte("k1"), []byte("v"))
+			return nil
+		})
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, errs, []error{nil, nil, nil})
+	ensure.DeepEqual(t, runs, 2) // run again, its snapshot did not have k25
+	db.TransactionalR(func(txn ReadTxner) {
+		ensure.DeepEqual(t, txn.(DupSortReader).GetAll(dupBucket, []byte("count")), [][]byte{[]byte("4")})
+	})
+}
+
+func TestRunOptimistic_IterateWritten(t *testing.T) {
+	path1, db1 := openDupSortDb("lmdb_test")
+	defer os.RemoveAll(path1)
+	defer db1.Close()
+	path2, db2 := openDupSortDb("lmdb_test")
+	defer os.RemoveAll(path2)
+	defer db2.Close()
+
+	// iterates what it wrote, and writes what it iterates
+	script := func(txn ReadWriteTxner) (log []string) {
+		txn.Put(testBucket, []byte("b"), []byte("B"))
+		txn.Put(testBucket, []byte("a"), []byte("A"))
+		for itr := txn.Iterate(testBucket); itr != nil; {
+			k, v := itr.Get()
+			log = append(log, fmt.Sprintf("%s=%s", k, v))
+			txn.Put(testBucket, append([]byte("0"), k...), v) // before the position
+			if !itr.Next() {
+				break
+			}
+		}
+		txn.PutDup(dupBucket, []byte("x"), []byte("1"))
+		txn.PutDup(dupBucket, []byte("x"), []byte("0"))
+		return append(log, fmt.Sprintf("%q", txn.GetAll(dupBucket, []byte("x"))))
+	}
+	var expected, log []string
+	ensure.Nil(t, db1.TransactionalRW(func(txn *ReadWriteTxn) error {
+		expected = script(txn)
+		return nil
+	}))
+	errs, err := db2.RunOptimistic(func(txn ReadWriteTxner) error {
+		log = script(txn)
+		return nil
+	})
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, errs, []error{nil})
+	ensure.DeepEqual(t, log, expected)
+	ensure.True(t, IsEqualDb(db1, db2))
+}
@@ -0,0 +1,244 @@
+package lmdb
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Environment flags, see mdb_env_open. Not all of them are exported by gomdb.
+const (
+	envNoSubdir    uint = 0x4000
+	envNoSync      uint = 0x10000
+	envReadOnly    uint = 0x20000
+	envNoMetaSync  uint = 0x40000
+	envWriteMap    uint = 0x80000
+	envMapAsync    uint = 0x100000
+	envNoTLS       uint = 0x200000 // always set, see "Thread Safety" in database.go
+	envNoReadAhead uint = 0x800000
+)
+
+// An Option configures the environment opened by Open.
+type Option func(*options) error
+
+type options struct {
+	mapSize    uint64
+	maxDBs     int
+	growthStep uint64
+	maxMapSize uint64
+	flags      uint // besides envNoTLS
+	maxReaders uint // 0: LMDB's default (126)
+	mode       os.FileMode
+
+	maxBatchSize  int
+	maxBatchDelay time.Duration
+
+	debug        DebugFlags
+	readPoolSize int
+
+	bucketFlags map[string]BucketFlags
+}
+
+func defaultOptions() options {
+	return options{
+		mapSize: MAP_SIZE_DEFAULT,
+		maxDBs:  MAX_DB_DEFAULT,
+		flags:   envNoReadAhead,
+		mode:    0664,
+
+		maxBatchSize:  MAX_BATCH_SIZE_DEFAULT,
+		maxBatchDelay: MAX_BATCH_DELAY_DEFAULT,
+		readPoolSize:  READ_POOL_SIZE_DEFAULT,
+
+		bucketFlags: make(map[string]BucketFlags),
+	}
+}
+
+func invalidOption(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidOption, fmt.Sprintf(format, args...))
+}
+
+// Checks the options against each other, and against the {buckets} passed to Open.
+func (o *options) validate(buckets []string) error {
+	readOnly := o.flags&envReadOnly != 0
+	for _, f := range []struct {
+		flag uint
+		name string
+	}{
+		{envNoSync, "WithNoSync"},
+		{envNoMetaSync, "WithNoMetaSync"},
+		{envWriteMap, "WithWriteMap"},
+		{envMapAsync, "WithMapAsync"},
+	} {
+		if readOnly && o.flags&f.flag != 0 {
+			return invalidOption("%s is meaningless for a read-only environment", f.name)
+		}
+	}
+	if readOnly && o.growthStep != 0 {
+		return invalidOption("the map of a read-only environment cannot grow")
+	}
+	if o.flags&envMapAsync != 0 && o.flags&envWriteMap == 0 {
+		return invalidOption("WithMapAsync requires WithWriteMap")
+	}
+	if o.growthStep != 0 && o.maxMapSize < o.mapSize {
+		return invalidOption("map growth ceiling %d is smaller than the map size %d",
+			o.maxMapSize, o.mapSize)
+	}
+	for name := range o.bucketFlags {
+		found := false
+		for _, bucket := range buckets {
+			found = found || bucket == name
+		}
+		if !found {
+			return invalidOption("WithBucketFlags: %s is not one of the buckets opened", name)
+		}
+	}
+	return nil
+}
+
+// Initial size of the map, MAP_SIZE_DEFAULT by default.
+func WithMapSize(size uint64) Option {
+	return func(o *options) error {
+		if size == 0 {
+			return invalidOption("map size must be positive")
+		}
+		o.mapSize = size
+		return nil
+	}
+}
+
+// Max number of buckets, MAX_DB_DEFAULT by default. Raised to the number of buckets passed to
+// Open if smaller.
+func WithMaxDBs(n int) Option {
+	return func(o *options) error {
+		if n < 0 {
+			return invalidOption("max dbs must not be negative")
+		}
+		o.maxDBs = n
+		return nil
+	}
+}
+
+// See Database.SetMapGrowth.
+func WithMapGrowth(step, ceiling uint64) Option {
+	return func(o *options) error {
+		o.growthStep = step
+		o.maxMapSize = ceiling
+		return nil
+	}
+}
+
+// See Database.SetBatchLimits. MAX_BATCH_SIZE_DEFAULT and MAX_BATCH_DELAY_DEFAULT by default.
+func WithBatchLimits(maxSize int, maxDelay time.Duration) Option {
+	return func(o *options) error {
+		if err := validateBatchLimits(maxSize, maxDelay); err != nil {
+			return fmt.Errorf("WithBatchLimits: %w", err)
+		}
+		o.maxBatchSize = maxSize
+		o.maxBatchDelay = maxDelay
+		return nil
+	}
+}
+
+// Max number of idle read txns kept for reuse, see "Read txn pool" in snapshot.go.
+// READ_POOL_SIZE_DEFAULT by default, 0 disables the pool. Lowered to half the max number of
+// readers (see WithMaxReaders) if larger.
+func WithReadPoolSize(n int) Option {
+	return func(o *options) error {
+		if n < 0 {
+			return invalidOption("read pool size must not be negative")
+		}
+		o.readPoolSize = n
+		return nil
+	}
+}
+
+// Open the environment read-only (MDB_RDONLY). All buckets passed to Open must exist, and write
+// txns fail.
+func WithReadOnly() Option {
+	return withFlag(envReadOnly)
+}
+
+// Treat the path as a single file rather than a directory (MDB_NOSUBDIR). The lock file is
+// the path with "-lock" appended.
+func WithNoSubdir() Option {
+	return withFlag(envNoSubdir)
+}
+
+// Don't fsync after commit (MDB_NOSYNC). A system crash may undo the last committed txns, or
+// corrupt the database unless the file system preserves write order.
+func WithNoSync() Option {
+	return withFlag(envNoSync)
+}
+
+// Fsync the data but not the meta page after commit (MDB_NOMETASYNC). A system crash may undo
+// the last committed txn, but won't corrupt the database.
+func WithNoMetaSync() Option {
+	return withFlag(envNoMetaSync)
+}
+
+// Use a writable memory map (MDB_WRITEMAP). Faster writes, but stray writes through the bytes
+// returned by GetNoCopy corrupt the database.
+func WithWriteMap() Option {
+	return withFlag(envWriteMap)
+}
+
+// Flush the writable map asynchronously (MDB_MAPASYNC). Requires WithWriteMap, and has the same
+// durability trade-off as WithNoSync.
+func WithMapAsync() Option {
+	return withFlag(envMapAsync)
+}
+
+// Max number of concurrent read txns, across all processes using the environment.
+func WithMaxReaders(n uint) Option {
+	return func(o *options) error {
+		if n == 0 {
+			return invalidOption("max readers must be positive")
+		}
+		o.maxReaders = n
+		return nil
+	}
+}
+
+// Permissions of the files created, 0664 by default.
+func WithFileMode(mode os.FileMode) Option {
+	return func(o *options) error {
+		if mode&^os.ModePerm != 0 {
+			return invalidOption("file mode %v has bits other than permissions", mode)
+		}
+		o.mode = mode
+		return nil
+	}
+}
+
+// Readahead is off by default (MDB_NORDAHEAD), which is better for random reads on databases
+// larger than RAM.
+func WithReadAhead(on bool) Option {
+	return func(o *options) error {
+		if on {
+			o.flags &^= envNoReadAhead
+		} else {
+			o.flags |= envNoReadAhead
+		}
+		return nil
+	}
+}
+
+// Flags of one of the buckets passed to Open. They must match the flags of the bucket if it
+// exists already.
+func WithBucketFlags(name string, flags BucketFlags) Option {
+	return func(o *options) error {
+		if err := flags.validate(); err != nil {
+			return invalidOption("WithBucketFlags: %s: %v", name, err)
+		}
+		o.bucketFlags[name] = flags
+		return nil
+	}
+}
+
+func withFlag(flag uint) Option {
+	return func(o *options) error {
+		o.flags |= flag
+		return nil
+	}
+}
@@ -0,0 +1,113 @@
+package lmdb
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestInvalidOptions(t *testing.T) {
+	path, err := ioutil.TempDir("", "lmdb_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(path)
+
+	cases := [][]Option{
+		{WithMapAsync()},
+		{WithReadOnly(), WithNoSync()},
+		{WithReadOnly(), WithWriteMap()},
+		{WithReadOnly(), WithMapGrowth(1<<20, 1<<30)},
+		{WithMapSize(1 << 30), WithMapGrowth(1<<20, 1<<20)},
+		{WithMaxReaders(0)},
+		{WithMapSize(0)},
+		{WithFileMode(os.ModeDir | 0700)},
+	}
+	for _, opts := range cases {
+		db, err := Open(path, []string{"bucket"}, opts...)
+		ensure.True(t, errors.Is(err, ErrInvalidOption))
+		db.Close()
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	path, err := ioutil.TempDir("", "lmdb_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(path)
+
+	func() {
+		db, err := Open(path, []string{"bucket"}, WithNoMetaSync())
+		defer db.Close()
+		ensure.Nil(t, err)
+		err = db.TransactionalRW(func(txn *ReadWriteTxn) error {
+			return txn.TryPut("bucket", []byte("foo"), []byte("bar"))
+		})
+		ensure.Nil(t, err)
+	}()
+
+	func() {
+		db, err := Open(path, []string{"bucket2"}, WithReadOnly())
+		defer db.Close()
+		ensure.True(t, errors.Is(err, ErrBucketNotFound))
+	}()
+
+	db, err := Open(path, []string{"bucket"}, WithReadOnly(), WithReadAhead(true))
+	defer db.Close()
+	ensure.Nil(t, err)
+
+	db.TransactionalR(func(txn ReadTxner) {
+		val, exist := txn.Get("bucket", []byte("foo"))
+		ensure.True(t, exist)
+		ensure.DeepEqual(t, val, []byte("bar"))
+	})
+	err = db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		return nil
+	})
+	ensure.NotNil(t, err)
+
+	buckets, err := db.GetExistingBuckets()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, buckets, []string{"bucket"})
+}
+
+func TestNoSubdir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lmdb_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "db")
+	db, err := Open(path, []string{"bucket"}, WithNoSubdir(), WithFileMode(0600),
+		WithMaxReaders(16))
+	defer db.Close()
+	ensure.Nil(t, err)
+
+	fi, err := os.Stat(path)
+	ensure.Nil(t, err)
+	ensure.False(t, fi.IsDir())
+	ensure.DeepEqual(t, db.Info().MaxReaders, uint(16))
+}
+
+// Open2 keeps its semantics: 0 lets LMDB choose the map size, a negative maxDB is raised.
+func TestOpen2(t *testing.T) {
+	path, err := ioutil.TempDir("", "lmdb_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(path)
+
+	db, err := Open2(path, []string{"bucket"}, 0, -1)
+	defer db.Close()
+	ensure.Nil(t, err)
+	ensure.True(t, db.Info().MapSize > 0)
+	ensure.Nil(t, db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		return txn.TryPut("bucket", []byte("foo"), []byte("bar"))
+	}))
+}
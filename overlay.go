@@ -0,0 +1,874 @@
+package lmdb
+
+import (
+	"errors"
+	"sort"
+	"syscall"
+
+	mdb "github.com/libreoscar/gomdb"
+)
+
+// Overlays
+//
+// An OverlayTxn reads a snapshot (a read txn, or a write txn it does not write to) and buffers its
+// writes in memory, sorted in the order of each bucket, instead of writing them to LMDB. Its reads
+// see its writes, and so do its iterators, which merge the buffered keys with the keys of the
+// snapshot. What it changed is then available as a TxnPatch, see OverlayTxn.Patch. Unlike
+// MakePatch, MakeOverlayPatch only needs a read txn, so it does not block the other writers; the
+// patch is relative to the snapshot, see ApplyPatchIfUnchanged to apply it safely later.
+//
+// Buckets can't be created or dropped in an OverlayTxn, and BucketStat fails for the buckets it
+// has written. Its iterators are registered in the snapshot, which closes them (see Iterator).
+//
+// The overlay txns of RunOptimistic (see optimistic.go) also record their reads, see read_set.go.
+// Writing a value to a DupSort bucket (or deleting one) records its key as read, since the values
+// of the key in the patch depend on its values in the snapshot.
+
+// The read/write surface shared by *ReadWriteTxn and the overlay txns.
+type ReadWriteTxner interface {
+	ReadTxner
+	TryReadTxner
+	DupSortReader
+	IntKeyReader
+	ContextTxner
+
+	Put(bucket string, key, val []byte)
+	Delete(bucket string, key []byte)
+	ClearBucket(bucket string)
+	TryPut(bucket string, key, val []byte) error
+	TryDelete(bucket string, key []byte) error
+	TryClearBucket(bucket string) error
+
+	// DupSort buckets only
+	PutDup(bucket string, key, val []byte)
+	DeleteDup(bucket string, key, val []byte)
+	TryPutDup(bucket string, key, val []byte) error
+	TryDeleteDup(bucket string, key, val []byte) error
+
+	// IntegerKey buckets only
+	PutUint64(bucket string, key uint64, val []byte)
+	PutUint32(bucket string, key uint32, val []byte)
+	DeleteUint64(bucket string, key uint64)
+	DeleteUint32(bucket string, key uint32)
+	TryPutUint64(bucket string, key uint64, val []byte) error
+	TryPutUint32(bucket string, key uint32, val []byte) error
+	TryDeleteUint64(bucket string, key uint64) error
+	TryDeleteUint32(bucket string, key uint32) error
+}
+
+// Max size of the keys (and of the values of DupSort buckets), see mdb_env_get_maxkeysize.
+const maxKeySize = 511
+
+var errOverlayStat = errors.New("bucket has buffered writes")
+
+// A write txn buffering its writes in memory, see "Overlays" in overlay.go. It may only be used
+// while its snapshot is.
+type OverlayTxn struct {
+	snap    *ReadTxn
+	reads   *readSet // nil if the reads are not tracked
+	buckets map[string]*overlayBucket
+}
+
+// The writes buffered in a bucket.
+type overlayBucket struct {
+	info    bucketInfo
+	cleared bool                  // the keys of the snapshot are deleted
+	keys    [][]byte              // the keys written, in the order of the bucket
+	states  map[string]*CellState // key -> state after the writes, never modified in place
+	version int                   // incremented by each write, see overlayCursor
+}
+
+// An overlay txn on {snapshot}, a read txn (e.g. txner.(*ReadTxn) in TransactionalR) or the
+// ReadTxn of a write txn.
+func NewOverlayTxn(snapshot *ReadTxn) *OverlayTxn {
+	return newOverlayTxn(snapshot, false)
+}
+
+// Runs {f} in an overlay txn on a new read snapshot, and returns what it changed, in canonical
+// order. Same as MakePatch, without holding the LMDB write lock.
+func (db *Database) MakeOverlayPatch(f func(*OverlayTxn) error) (patch TxnPatch, err error) {
+	err = db.TryTransactionalR(func(txner ReadTxner) error {
+		o := NewOverlayTxn(txner.(*ReadTxn))
+		if err := f(o); err != nil {
+			return err
+		}
+		patch = o.Patch()
+		return nil
+	})
+	return
+}
+
+func newOverlayTxn(snap *ReadTxn, trackReads bool) *OverlayTxn {
+	o := &OverlayTxn{snap: snap, buckets: make(map[string]*overlayBucket)}
+	if trackReads {
+		o.reads = newReadSet()
+	}
+	return o
+}
+
+// Returns the info of {bucket} and its buffered writes, nil if there are none unless {create}.
+func (o *OverlayTxn) bucket(name string, create bool) (bucketInfo, *overlayBucket, error) {
+	info, err := o.snap.bucketInfo(name)
+	if err != nil {
+		return info, nil, err
+	}
+	ob := o.buckets[name]
+	if ob == nil && create {
+		ob = &overlayBucket{info: info, states: make(map[string]*CellState)}
+		o.buckets[name] = ob
+	}
+	return info, ob, nil
+}
+
+// The state of {key} set by the writes, nil if it is the one of the snapshot.
+func (ob *overlayBucket) state(key []byte) *CellState {
+	if ob == nil {
+		return nil
+	}
+	if state, ok := ob.states[string(key)]; ok {
+		return state
+	} else if ob.cleared {
+		return &CellState{}
+	}
+	return nil
+}
+
+func (ob *overlayBucket) set(key []byte, state *CellState) {
+	if _, ok := ob.states[string(key)]; !ok {
+		i := sort.Search(len(ob.keys), func(i int) bool {
+			return ob.info.compareKeys(ob.keys[i], key) >= 0
+		})
+		ob.keys = append(ob.keys, nil)
+		copy(ob.keys[i+1:], ob.keys[i:])
+		ob.keys[i] = append([]byte{}, key...)
+	}
+	ob.states[string(key)] = state
+	ob.version++
+}
+
+func (ob *overlayBucket) clone() *overlayBucket {
+	states := make(map[string]*CellState, len(ob.states))
+	for key, state := range ob.states {
+		states[key] = state
+	}
+	return &overlayBucket{ob.info, ob.cleared, append([][]byte(nil), ob.keys...), states, 0}
+}
+
+func (ob *overlayBucket) clear() {
+	ob.cleared = true
+	ob.keys = nil
+	ob.states = make(map[string]*CellState)
+	ob.version++
+}
+
+// The state of {key} seen by the txn, not recorded as a read.
+func (o *OverlayTxn) cellState(bucket string, ob *overlayBucket, key []byte) (CellState, error) {
+	if state := ob.state(key); state != nil {
+		return *state, nil
+	}
+	return o.snap.tryGetCellState(bucket, key)
+}
+
+// What the txn changed so far, in canonical order.
+func (o *OverlayTxn) Patch() TxnPatch {
+	var patch TxnPatch
+	for bucket, ob := range o.buckets {
+		if ob.cleared {
+			patch = append(patch, NewClearCell(bucket))
+		}
+		for _, key := range ob.keys {
+			patch = append(patch, PatchCell{Bucket: bucket, Key: key, CellState: *ob.states[string(key)]})
+		}
+	}
+	patch.sortCells()
+	return patch.dropClearedDeletes()
+}
+
+// Runs {f} in the txn. Returns its changes (nil if it fails), its reads (nil if not tracked), and
+// its panic if any.
+func (o *OverlayTxn) run(f func(ReadWriteTxner) error) (
+	patch TxnPatch, reads *ReadSet, panicF interface{}, err error) {
+
+	n := len(o.snap.itrs)
+	func() {
+		defer func() {
+			panicF = recover()
+		}()
+		err = f(o)
+	}()
+
+	o.snap.closeIterators(n)
+	if err == nil && panicF == nil {
+		patch = o.Patch()
+	}
+	if o.reads != nil {
+		reads = o.reads.export()
+	}
+	return
+}
+
+func copyValues(vals [][]byte) [][]byte {
+	if vals == nil {
+		return nil
+	}
+	copied := make([][]byte, len(vals))
+	for i, v := range vals {
+		copied[i] = append([]byte(nil), v...)
+	}
+	return copied
+}
+
+//--------------------------------- Reads ---------------------------------------------------------
+
+func (o *OverlayTxn) TryBucketStat(bucket string) (*Stat, error) {
+	_, ob, err := o.bucket(bucket, false)
+	if err != nil {
+		return nil, err
+	} else if ob != nil && ob.version > 0 {
+		return nil, &Error{"stat", bucket, nil, errOverlayStat}
+	}
+	return o.snap.TryBucketStat(bucket)
+}
+
+func (o *OverlayTxn) BucketStat(bucket string) *Stat {
+	stat, err := o.TryBucketStat(bucket)
+	if err != nil {
+		panic(err)
+	}
+	return stat
+}
+
+func (o *OverlayTxn) TryGetNoCopy(bucket string, key []byte) ([]byte, bool, error) {
+	o.reads.recordKey(bucket, key)
+	_, ob, err := o.bucket(bucket, false)
+	if err != nil {
+		return nil, false, err
+	}
+	state := ob.state(key)
+	if state == nil {
+		v, exist, err := o.snap.getVal(bucket, key)
+		if !exist {
+			return nil, false, err
+		}
+		return o.snap.trackNoCopy(v.BytesNoCopy()), true, nil
+	}
+	switch {
+	case !state.Exists:
+		return nil, false, nil
+	case state.Values != nil:
+		return o.snap.trackNoCopy(state.Values[0]), true, nil
+	}
+	return o.snap.trackNoCopy(state.Value), true, nil
+}
+
+func (o *OverlayTxn) GetNoCopy(bucket string, key []byte) ([]byte, bool) {
+	v, exist, err := o.TryGetNoCopy(bucket, key)
+	if err != nil {
+		panic(err)
+	}
+	return v, exist
+}
+
+func (o *OverlayTxn) TryGet(bucket string, key []byte) ([]byte, bool, error) {
+	v, exist, err := o.TryGetNoCopy(bucket, key)
+	if !exist {
+		return nil, false, err
+	}
+	return append([]byte(nil), v...), true, nil
+}
+
+func (o *OverlayTxn) Get(bucket string, key []byte) ([]byte, bool) {
+	v, exist, err := o.TryGet(bucket, key)
+	if err != nil {
+		panic(err)
+	}
+	return v, exist
+}
+
+func (o *OverlayTxn) TryGetAll(bucket string, key []byte) ([][]byte, error) {
+	o.reads.recordKey(bucket, key)
+	if _, err := o.snap.dupSortBucket(bucket); err != nil {
+		return nil, err
+	}
+	if state := o.buckets[bucket].state(key); state != nil {
+		return copyValues(state.Values), nil
+	}
+	return o.snap.getAll(bucket, key)
+}
+
+func (o *OverlayTxn) GetAll(bucket string, key []byte) [][]byte {
+	vals, err := o.TryGetAll(bucket, key)
+	if err != nil {
+		panic(err)
+	}
+	return vals
+}
+
+func (o *OverlayTxn) TryCountDups(bucket string, key []byte) (uint64, error) {
+	o.reads.recordKey(bucket, key)
+	if _, err := o.snap.dupSortBucket(bucket); err != nil {
+		return 0, err
+	}
+	if state := o.buckets[bucket].state(key); state != nil {
+		return uint64(len(state.Values)), nil
+	}
+	return o.snap.countDups(bucket, key)
+}
+
+func (o *OverlayTxn) CountDups(bucket string, key []byte) uint64 {
+	n, err := o.TryCountDups(bucket, key)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func (o *OverlayTxn) TryGetUint64(bucket string, key uint64) ([]byte, bool, error) {
+	return o.TryGet(bucket, EncodeUint64(key))
+}
+
+func (o *OverlayTxn) GetUint64(bucket string, key uint64) ([]byte, bool) {
+	return o.Get(bucket, EncodeUint64(key))
+}
+
+func (o *OverlayTxn) TryGetUint32(bucket string, key uint32) ([]byte, bool, error) {
+	return o.TryGet(bucket, EncodeUint32(key))
+}
+
+func (o *OverlayTxn) GetUint32(bucket string, key uint32) ([]byte, bool) {
+	return o.Get(bucket, EncodeUint32(key))
+}
+
+func (o *OverlayTxn) TryIterate(bucket string) (*Iterator, error) {
+	info, ob, err := o.bucket(bucket, true)
+	if err != nil {
+		return nil, err
+	}
+	cur, err := o.snap.txn.CursorOpen(info.dbi)
+	if err != nil {
+		return nil, wrapError("open cursor", bucket, nil, err)
+	}
+
+	itr := newIterator(cur, iterState{reads: o.reads, bucket: bucket, owner: o.snap.owner,
+		txn: o.snap, dbi: info.dbi, gen: o.snap.bucketGen,
+		overlay: &overlayCursor{txn: o, bucket: bucket, ob: ob, cur: cur, idx: -1}})
+
+	ok, err := itr.TrySeekFirst()
+	if ok {
+		o.snap.itrs = append(o.snap.itrs, itr)
+		return itr, nil
+	}
+	itr.Close()
+	return nil, err
+}
+
+// Return an iterator pointing to the first item in the bucket.
+// If the bucket is empty, nil is returned.
+func (o *OverlayTxn) Iterate(bucket string) *Iterator {
+	itr, err := o.TryIterate(bucket)
+	if err != nil {
+		panic(err)
+	}
+	return itr
+}
+
+func (o *OverlayTxn) TryIsBucketEmpty(bucket string) (bool, error) {
+	itr, err := o.TryIterate(bucket)
+	return itr == nil, err
+}
+
+// Panic if {bucket} does not exist.
+func (o *OverlayTxn) IsBucketEmpty(bucket string) bool {
+	return o.Iterate(bucket) == nil
+}
+
+//--------------------------------- Writes --------------------------------------------------------
+
+// Runs {f} in a nested txn: its writes are kept if {f} returns nil, and discarded if it returns an
+// error or panics, as in ReadWriteTxn.TransactionalRW.
+func (o *OverlayTxn) TransactionalRW(f func(*OverlayTxn) error) (err error) {
+	child := &OverlayTxn{snap: o.snap, reads: o.reads.child(),
+		buckets: make(map[string]*overlayBucket, len(o.buckets))}
+	for name, ob := range o.buckets {
+		child.buckets[name] = ob.clone()
+	}
+	n := len(o.snap.itrs)
+	defer func() {
+		o.snap.closeIterators(n)
+		o.reads.merge(child.reads) // even if rolled back, see read_set.go
+	}()
+
+	if err = f(child); err != nil {
+		return err
+	}
+	for name, nested := range child.buckets {
+		ob := o.buckets[name]
+		if ob == nil {
+			o.buckets[name] = nested
+			continue
+		}
+		// the iterators of the txn keep using {ob}
+		ob.cleared, ob.keys, ob.states = nested.cleared, nested.keys, nested.states
+		ob.version++
+	}
+	return nil
+}
+
+// Stops at, and returns, the first error.
+func (o *OverlayTxn) ApplyPatch(patch TxnPatch) error {
+	return applyPatch(o, patch)
+}
+
+// Checks what LMDB would reject when the patch is applied.
+func checkKeySizes(op string, bucket string, info bucketInfo, key, val []byte) error {
+	if err := info.checkSizes(op, bucket, key, val); err != nil {
+		return err
+	}
+	if len(key) == 0 || len(key) > maxKeySize || info.flags&DupSort != 0 && len(val) > maxKeySize {
+		return &Error{op, bucket, key, ErrKeyTooLarge}
+	}
+	return nil
+}
+
+// Same as checkKeySizes, and checks the sizes of the integer buckets against those of the keys
+// (values) they hold after the writes, see "Integer buckets" in intkey.go.
+func (o *OverlayTxn) checkKeySizes(op string, bucket string, info bucketInfo, ob *overlayBucket,
+	key, val []byte) error {
+
+	err := checkKeySizes(op, bucket, info, key, val)
+	if err != nil || info.flags&(IntegerKey|IntegerDup) == 0 {
+		return err
+	}
+	cur, err := o.snap.txn.CursorOpen(info.dbi)
+	if err != nil {
+		return wrapError("open cursor", bucket, nil, err)
+	}
+	defer cur.Close()
+	c := &overlayCursor{txn: o, bucket: bucket, ob: ob, cur: cur, idx: -1}
+	first, firstVal, err := c.get(nil, nil, mdb.FIRST)
+	if err == mdb.NotFound {
+		return nil
+	} else if err != nil {
+		return wrapError(op, bucket, key, err)
+	}
+	return info.checkIntegerSizes(op, bucket, key, val, first, firstVal)
+}
+
+func (o *OverlayTxn) TryPut(bucket string, key, val []byte) error {
+	info, ob, err := o.bucket(bucket, true)
+	if err == nil {
+		err = o.checkKeySizes("put", bucket, info, ob, key, val)
+	}
+	if err != nil {
+		return err
+	}
+	if info.flags&DupSort == 0 {
+		ob.set(key, &CellState{Exists: true, Value: append([]byte(nil), val...)})
+		return nil
+	}
+
+	o.reads.recordKey(bucket, key)
+	state, err := o.cellState(bucket, ob, key)
+	if err != nil {
+		return err
+	}
+	i := sort.Search(len(state.Values), func(i int) bool {
+		return info.compareDups(state.Values[i], val) >= 0
+	})
+	vals := append([][]byte{}, state.Values[:i]...)
+	if i == len(state.Values) || info.compareDups(state.Values[i], val) != 0 {
+		vals = append(vals, append([]byte(nil), val...))
+	}
+	vals = append(vals, state.Values[i:]...)
+	ob.set(key, &CellState{Exists: true, Values: vals})
+	return nil
+}
+
+func (o *OverlayTxn) Put(bucket string, key, val []byte) {
+	err := o.TryPut(bucket, key, val)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (o *OverlayTxn) TryDelete(bucket string, key []byte) error {
+	info, ob, err := o.bucket(bucket, true)
+	if err == nil {
+		err = o.checkKeySizes("delete", bucket, info, ob, key, nil)
+	}
+	if err != nil {
+		return err
+	}
+	ob.set(key, &CellState{})
+	return nil
+}
+
+func (o *OverlayTxn) Delete(bucket string, key []byte) {
+	err := o.TryDelete(bucket, key)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (o *OverlayTxn) TryClearBucket(bucket string) error {
+	_, ob, err := o.bucket(bucket, true)
+	if err != nil {
+		return err
+	}
+	ob.clear()
+	return nil
+}
+
+func (o *OverlayTxn) ClearBucket(bucket string) {
+	err := o.TryClearBucket(bucket)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (o *OverlayTxn) TryPutDup(bucket string, key, val []byte) error {
+	if _, err := o.snap.dupSortBucket(bucket); err != nil {
+		return err
+	}
+	return o.TryPut(bucket, key, val)
+}
+
+func (o *OverlayTxn) PutDup(bucket string, key, val []byte) {
+	err := o.TryPutDup(bucket, key, val)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (o *OverlayTxn) TryDeleteDup(bucket string, key, val []byte) error {
+	info, err := o.snap.dupSortBucket(bucket)
+	if err != nil {
+		return err
+	}
+	_, ob, _ := o.bucket(bucket, true)
+	if err = o.checkKeySizes("delete", bucket, info, ob, key, val); err != nil {
+		return err
+	}
+
+	o.reads.recordKey(bucket, key)
+	state, err := o.cellState(bucket, ob, key)
+	if err != nil {
+		return err
+	}
+	var vals [][]byte
+	for _, v := range state.Values {
+		if info.compareDups(v, val) != 0 {
+			vals = append(vals, v)
+		}
+	}
+	if vals == nil {
+		ob.set(key, &CellState{})
+	} else {
+		ob.set(key, &CellState{Exists: true, Values: vals})
+	}
+	return nil
+}
+
+func (o *OverlayTxn) DeleteDup(bucket string, key, val []byte) {
+	err := o.TryDeleteDup(bucket, key, val)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (o *OverlayTxn) TryPutUint64(bucket string, key uint64, val []byte) error {
+	return o.TryPut(bucket, EncodeUint64(key), val)
+}
+
+func (o *OverlayTxn) PutUint64(bucket string, key uint64, val []byte) {
+	o.Put(bucket, EncodeUint64(key), val)
+}
+
+func (o *OverlayTxn) TryPutUint32(bucket string, key uint32, val []byte) error {
+	return o.TryPut(bucket, EncodeUint32(key), val)
+}
+
+func (o *OverlayTxn) PutUint32(bucket string, key uint32, val []byte) {
+	o.Put(bucket, EncodeUint32(key), val)
+}
+
+func (o *OverlayTxn) TryDeleteUint64(bucket string, key uint64) error {
+	return o.TryDelete(bucket, EncodeUint64(key))
+}
+
+func (o *OverlayTxn) DeleteUint64(bucket string, key uint64) {
+	o.Delete(bucket, EncodeUint64(key))
+}
+
+func (o *OverlayTxn) TryDeleteUint32(bucket string, key uint32) error {
+	return o.TryDelete(bucket, EncodeUint32(key))
+}
+
+func (o *OverlayTxn) DeleteUint32(bucket string, key uint32) {
+	o.Delete(bucket, EncodeUint32(key))
+}
+
+//--------------------------------- Iterator ------------------------------------------------------
+
+// Cursor of an iterator of an overlay txn. It visits the buffered keys merged with the keys of the
+// snapshot which are not buffered. The values of the current key are loaded when the cursor moves
+// to it, and again if the bucket is written meanwhile.
+type overlayCursor struct {
+	txn     *OverlayTxn
+	bucket  string
+	ob      *overlayBucket
+	cur     *mdb.Cursor // on the snapshot
+	key     []byte      // nil if not positioned
+	vals    [][]byte    // values of {key}, empty if it has been deleted
+	idx     int         // index of the current value in {vals}, -1 if none
+	version int         // of {ob} when {vals} were loaded
+}
+
+// Same as mdb.Cursor.GetVal, for the ops used by Iterator. The key and value are not copied.
+func (c *overlayCursor) get(k, v []byte, op uint) ([]byte, []byte, error) {
+	if err := c.refresh(); err != nil {
+		return nil, nil, err
+	}
+
+	var err error
+	switch op {
+	case mdb.GET_CURRENT:
+		if c.key != nil && c.idx < 0 {
+			err = mdb.NotFound
+		}
+	case mdb.FIRST:
+		err = c.seek(nil, false, false, false)
+	case mdb.LAST:
+		err = c.seek(nil, false, true, true)
+	case mdb.NEXT:
+		if c.key != nil && c.idx+1 < len(c.vals) {
+			c.idx++
+		} else {
+			err = c.seek(c.key, c.key != nil, false, false)
+		}
+	case mdb.PREV:
+		if c.key != nil && c.idx > 0 {
+			c.idx--
+		} else {
+			err = c.seek(c.key, c.key != nil, true, true)
+		}
+	case mdb.NEXT_NODUP:
+		err = c.seek(c.key, c.key != nil, false, false)
+	case mdb.PREV_NODUP:
+		err = c.seek(c.key, c.key != nil, true, true)
+	case mdb.NEXT_DUP:
+		err = c.dup(c.idx + 1)
+	case mdb.PREV_DUP:
+		err = c.dup(c.idx - 1)
+	case mdb.FIRST_DUP:
+		err = c.dup(0)
+	case mdb.LAST_DUP:
+		err = c.dup(len(c.vals) - 1)
+	case mdb.SET_RANGE:
+		err = c.seek(k, false, false, false)
+	case mdb.GET_BOTH, mdb.GET_BOTH_RANGE:
+		err = c.seekBoth(k, v, op == mdb.GET_BOTH_RANGE)
+	default:
+		err = syscall.EINVAL
+	}
+	if err == nil && c.key == nil {
+		err = syscall.EINVAL // not positioned
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.key, c.vals[c.idx], nil
+}
+
+func (c *overlayCursor) count() (uint64, error) {
+	if err := c.refresh(); err != nil {
+		return 0, err
+	} else if c.key == nil || c.idx < 0 {
+		return 0, syscall.EINVAL
+	}
+	return uint64(len(c.vals)), nil
+}
+
+// Reloads the values of the current key if the bucket has been written since they were loaded.
+func (c *overlayCursor) refresh() error {
+	if c.key == nil || c.version == c.ob.version {
+		return nil
+	}
+	vals, err := c.values(c.key)
+	if err != nil {
+		return err
+	}
+
+	idx := -1
+	if len(vals) > 0 {
+		idx = 0
+		if c.idx >= 0 { // stay on the current value, or move to the next one
+			v := c.vals[c.idx]
+			idx = sort.Search(len(vals), func(i int) bool {
+				return c.ob.info.compareDups(vals[i], v) >= 0
+			})
+			if idx == len(vals) {
+				idx--
+			}
+		}
+	}
+	c.vals, c.idx, c.version = vals, idx, c.ob.version
+	return nil
+}
+
+func (c *overlayCursor) values(key []byte) ([][]byte, error) {
+	state, err := c.txn.cellState(c.bucket, c.ob, key)
+	if err != nil || !state.Exists {
+		return nil, err
+	} else if state.Values != nil {
+		return state.Values, nil
+	}
+	return [][]byte{state.Value}, nil
+}
+
+// Positions at the key found by find, on its first value (its last if {last}). Returns
+// mdb.NotFound and stays where it is if there is no such key.
+func (c *overlayCursor) seek(k []byte, strict, backward, last bool) error {
+	key, err := c.find(k, strict, backward)
+	if err != nil {
+		return err
+	}
+	vals, err := c.values(key)
+	if err != nil {
+		return err
+	}
+	c.key, c.vals, c.version = key, vals, c.ob.version
+	c.idx = 0
+	if last {
+		c.idx = len(vals) - 1
+	}
+	return nil
+}
+
+func (c *overlayCursor) seekBoth(k, v []byte, orGreater bool) error {
+	key, err := c.find(k, false, false)
+	if err != nil {
+		return err
+	} else if c.ob.info.compareKeys(key, k) != 0 {
+		return mdb.NotFound
+	}
+	vals, err := c.values(key)
+	if err != nil {
+		return err
+	}
+	cmp := c.ob.info.compareDups
+	i := sort.Search(len(vals), func(i int) bool { return cmp(vals[i], v) >= 0 })
+	if i == len(vals) || !orGreater && cmp(vals[i], v) != 0 {
+		return mdb.NotFound
+	}
+	c.key, c.vals, c.idx, c.version = key, vals, i, c.ob.version
+	return nil
+}
+
+func (c *overlayCursor) dup(idx int) error {
+	if c.key == nil {
+		return syscall.EINVAL
+	} else if idx < 0 || idx >= len(c.vals) {
+		return mdb.NotFound
+	}
+	c.idx = idx
+	return nil
+}
+
+// Finds the first key >= {k} (> if {strict}), or the last key <= {k} (<) if {backward}. A nil {k}
+// finds the first (last) key. Returns mdb.NotFound if there is none.
+func (c *overlayCursor) find(k []byte, strict, backward bool) ([]byte, error) {
+	snapKey, err := c.snapFind(k, strict, backward)
+	if err != nil {
+		return nil, err
+	}
+	bufKey := c.bufFind(k, strict, backward)
+	switch {
+	case snapKey == nil && bufKey == nil:
+		return nil, mdb.NotFound
+	case snapKey == nil:
+		return bufKey, nil
+	case bufKey == nil:
+		return snapKey, nil
+	}
+	// never equal, the buffered keys are skipped in the snapshot
+	if (c.ob.info.compareKeys(snapKey, bufKey) > 0) == backward {
+		return snapKey, nil
+	}
+	return bufKey, nil
+}
+
+// Same as find, among the keys of the snapshot which are not buffered. Returns nil if none.
+func (c *overlayCursor) snapFind(k []byte, strict, backward bool) ([]byte, error) {
+	if c.ob.cleared {
+		return nil, nil
+	}
+	step := uint(mdb.NEXT_NODUP)
+	if backward {
+		step = mdb.PREV_NODUP
+	}
+
+	var key mdb.Val
+	var err error
+	switch {
+	case k == nil && backward:
+		key, _, err = c.cur.GetVal(nil, nil, mdb.LAST)
+	case k == nil:
+		key, _, err = c.cur.GetVal(nil, nil, mdb.FIRST)
+	default:
+		key, _, err = c.cur.GetVal(k, nil, mdb.SET_RANGE)
+		if err == mdb.NotFound && backward { // all keys are < {k}
+			key, _, err = c.cur.GetVal(nil, nil, mdb.LAST)
+		} else if err == nil {
+			cmp := c.ob.info.compareKeys(key.BytesNoCopy(), k)
+			if cmp == 0 && strict || cmp > 0 && backward {
+				key, _, err = c.cur.GetVal(nil, nil, step)
+			}
+		}
+	}
+
+	for err == nil {
+		if _, buffered := c.ob.states[string(key.BytesNoCopy())]; !buffered {
+			return key.Bytes(), nil
+		}
+		key, _, err = c.cur.GetVal(nil, nil, step)
+	}
+	if err == mdb.NotFound {
+		return nil, nil
+	}
+	return nil, wrapError("move cursor", c.bucket, nil, err)
+}
+
+// Same as find, among the buffered keys which exist. Returns nil if none.
+func (c *overlayCursor) bufFind(k []byte, strict, backward bool) []byte {
+	keys, cmp := c.ob.keys, c.ob.info.compareKeys
+	if backward {
+		i := len(keys) - 1
+		if k != nil {
+			i = sort.Search(len(keys), func(i int) bool {
+				r := cmp(keys[i], k)
+				return r > 0 || strict && r == 0
+			}) - 1
+		}
+		for ; i >= 0; i-- {
+			if c.ob.states[string(keys[i])].Exists {
+				return keys[i]
+			}
+		}
+		return nil
+	}
+
+	i := 0
+	if k != nil {
+		i = sort.Search(len(keys), func(i int) bool {
+			r := cmp(keys[i], k)
+			return r > 0 || !strict && r == 0
+		})
+	}
+	for ; i < len(keys); i++ {
+		if c.ob.states[string(keys[i])].Exists {
+			return keys[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package lmdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+func initOverlayDb(txn *ReadWriteTxn) error {
+	for _, k := range []string{"a", "b", "c", "d"} {
+		txn.Put(testBucket, []byte(k), []byte(k))
+	}
+	txn.PutDup(dupBucket, []byte("x"), []byte("1"))
+	txn.PutDup(dupBucket, []byte("x"), []byte("2"))
+	txn.PutDup(dupBucket, []byte("y"), []byte("1"))
+	return nil
+}
+
+// Logs what {txn} sees while writing, to compare an overlay txn with a ReadWriteTxn.
+func overlayScript(txn ReadWriteTxner) (log []string) {
+	logf := func(format string, args ...interface{}) {
+		log = append(log, fmt.Sprintf(format, args...))
+	}
+	logItr := func(itr *Iterator, next func() bool) {
+		for ok := itr != nil; ok; ok = next() {
+			k, v := itr.Get()
+			logf("%s=%s", k, v)
+		}
+	}
+
+	txn.Put(testBucket, []byte("b"), []byte("B"))
+	txn.Delete(testBucket, []byte("c"))
+	txn.Put(testBucket, []byte("bb"), []byte("BB"))
+	txn.Put(testBucket, []byte("e"), nil)
+	txn.PutDup(dupBucket, []byte("x"), []byte("3"))
+	txn.DeleteDup(dupBucket, []byte("x"), []byte("1"))
+	txn.PutDup(dupBucket, []byte("z"), []byte("5"))
+	txn.PutDup(dupBucket, []byte("z"), []byte("4"))
+	txn.Delete(dupBucket, []byte("y"))
+
+	b, _ := txn.Get(testBucket, []byte("b"))
+	_, c := txn.Get(testBucket, []byte("c"))
+	x, _ := txn.Get(dupBucket, []byte("x"))
+	logf("%s %v %s %d %q", b, c, x, txn.CountDups(dupBucket, []byte("x")),
+		txn.GetAll(dupBucket, []byte("z")))
+
+	itr := txn.Iterate(testBucket)
+	logItr(itr, itr.Next)
+	logf("%v", itr.SeekLast())
+	logItr(itr, itr.Prev)
+	logf("%v", itr.SeekGE([]byte("bc")))
+	logItr(itr, itr.Next)
+	logf("%v %v", itr.SeekExact([]byte("c")), itr.SeekByPrefix([]byte("b")))
+	logItr(itr, itr.Next)
+
+	itr = txn.Iterate(dupBucket)
+	logItr(itr, itr.Next)
+	logf("%v", itr.SeekBothGE([]byte("x"), []byte("25")))
+	logItr(itr, itr.NextDup)
+	logf("%v %v", itr.SeekBoth([]byte("z"), []byte("5")), itr.PrevNoDup())
+	logItr(itr, itr.PrevDup)
+	logf("%v %d", itr.NextNoDup(), itr.CountDups())
+	logItr(itr, itr.NextNoDup)
+
+	txn.ClearBucket(testBucket)
+	txn.Put(testBucket, []byte("q"), []byte("Q"))
+	itr = txn.Iterate(testBucket)
+	logItr(itr, itr.Next)
+	return
+}
+
+func TestOverlayTxn(t *testing.T) {
+	path1, db1 := openDupSortDb("lmdb_test")
+	defer os.RemoveAll(path1)
+	defer db1.Close()
+	path2, db2 := openDupSortDb("lmdb_test")
+	defer os.RemoveAll(path2)
+	defer db2.Close()
+
+	var expected, log []string
+	db1.TransactionalRW(initOverlayDb)
+	db1.TransactionalRW(func(txn *ReadWriteTxn) error {
+		expected = overlayScript(txn)
+		return nil
+	})
+
+	db2.TransactionalRW(initOverlayDb)
+	errs, err := db2.RunOptimistic(func(txn ReadWriteTxner) error {
+		log = overlayScript(txn)
+		return nil
+	})
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, errs, []error{nil})
+	ensure.DeepEqual(t, log, expected)
+	ensure.True(t, IsEqualDb(db1, db2))
+}
+
+func TestMakeOverlayPatch(t *testing.T) {
+	path, db := openDupSortDb("lmdb_test")
+	defer os.RemoveAll(path)
+	defer db.Close()
+	db.TransactionalRW(initOverlayDb)
+
+	expected, err := MakePatch(db, func(txn *ReadWriteTxn) error {
+		overlayScript(txn)
+		return nil
+	})
+	ensure.Nil(t, err)
+	patch, err := db.MakeOverlayPatch(func(txn *OverlayTxn) error {
+		overlayScript(txn)
+		return nil
+	})
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, patch, expected)
+
+	// nested txns
+	patch, err = db.MakeOverlayPatch(func(txn *OverlayTxn) error {
+		itr := txn.Iterate(testBucket)
+		err := txn.TransactionalRW(func(txn *OverlayTxn) error {
+			txn.Put(testBucket, []byte("0"), nil)
+			return errors.New("rolled back")
+		})
+		ensure.NotNil(t, err)
+		ensure.Nil(t, txn.TransactionalRW(func(txn *OverlayTxn) error {
+			txn.Delete(testBucket, []byte("a"))
+			return txn.TransactionalRW(func(txn *OverlayTxn) error {
+				txn.Put(testBucket, []byte("aa"), []byte("AA"))
+				return nil
+			})
+		}))
+
+		// the iterator sees the changes of the nested txns
+		ensure.True(t, itr.Next())
+		k, v := itr.Get()
+		ensure.DeepEqual(t, string(k)+"="+string(v), "aa=AA")
+		ensure.True(t, itr.SeekFirst())
+		k, _ = itr.Get()
+		ensure.DeepEqual(t, string(k), "aa")
+		return nil
+	})
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, patch, TxnPatch{
+		NewDeleteCell(testBucket, []byte("a")),
+		NewPutCell(testBucket, []byte("aa"), []byte("AA")),
+	})
+
+	// no write lock: a patch is made while a write txn is open
+	db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		txn.Put(testBucket, []byte("uncommitted"), nil)
+		patch, err = db.MakeOverlayPatch(func(txn *OverlayTxn) error {
+			_, ok := txn.Get(testBucket, []byte("uncommitted"))
+			ensure.False(t, ok)
+			return txn.ApplyPatch(expected)
+		})
+		return err
+	})
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, patch, expected)
+}
@@ -0,0 +1,386 @@
+package lmdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// Binary format of a TxnPatch
+//
+//	patch = magic ("LMDP") | version (1 byte) | uvarint(#cells) | cell... | crc (4 bytes)
+//	cell  = bytes(bucket) | bytes(key) | state | prior state (if the cell has one)
+//	state = flags (1 byte) | value
+//	value = nothing                                      if !exists
+//	      | bytes(value)                                 if exists and not DupSort
+//	      | uvarint(#values) | bytes(value)...           if exists and DupSort
+//	bytes(b) = uvarint(len(b)) | b
+//
+// #values is at least 1: a DupSort state without values is encoded as a missing key, as
+// NewPutDupsCell does, and rejected by the decoder.
+//
+// The flags are cellExists | cellDups, plus cellPrior in the flags of the (first) state of the
+// cells of reversible patches. A clear cell has an empty key and the flags cellClear (plus
+// cellPrior, its prior state being empty); the other cells must have a key. The crc is the big-endian CRC-32C of all the bytes before
+// it. A patch which fails to decode (bad magic, unknown version, truncated, wrong crc...) is
+// rejected with ErrCorruptedPatch as a whole, so a partially decoded patch is never applied.
+//
+// The version is bumped by each change of the format. Patches are written in the last version,
+// and read in any version up to it:
+//
+//	1: the first format. A cell with an empty key is a clear cell, whatever its flags.
+//	2: clear cells are marked with cellClear.
+
+const (
+	patchMagic   = "LMDP"
+	patchVersion = 2
+
+	cellExists = 1 << 0
+	cellDups   = 1 << 1
+	cellPrior  = 1 << 2
+	cellClear  = 1 << 3
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func corruptedPatch(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrCorruptedPatch, fmt.Sprintf(format, args...))
+}
+
+func (p TxnPatch) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	err := NewPatchEncoder(&buf).Encode(p)
+	return buf.Bytes(), err
+}
+
+// Fails with ErrCorruptedPatch if {data} is not exactly one valid patch.
+func (p *TxnPatch) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	patch, err := NewPatchDecoder(r).Decode()
+	if err != nil {
+		return err
+	}
+	if r.Len() != 0 {
+		return corruptedPatch("%d trailing bytes", r.Len())
+	}
+	*p = patch
+	return nil
+}
+
+// Size of the binary encoding of the patch.
+func (p TxnPatch) SizeBytes() int {
+	size := len(patchMagic) + 1 + uvarintLen(uint64(len(p))) + 4
+	bytesLen := func(b []byte) int {
+		return uvarintLen(uint64(len(b))) + len(b)
+	}
+	stateLen := func(state *CellState) int {
+		n := 1
+		switch {
+		case state.Exists && len(state.Values) > 0:
+			n += uvarintLen(uint64(len(state.Values)))
+			for _, dup := range state.Values {
+				n += bytesLen(dup)
+			}
+		case state.Exists && state.Values == nil:
+			n += bytesLen(state.Value)
+		}
+		return n
+	}
+	for i := range p {
+		cell := &p[i]
+		size += bytesLen([]byte(cell.Bucket)) + bytesLen(cell.Key) + stateLen(&cell.CellState)
+		if cell.Prior != nil {
+			size += stateLen(cell.Prior)
+		}
+	}
+	return size
+}
+
+func uvarintLen(n uint64) int {
+	var b [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(b[:], n)
+}
+
+//--------------------------------- PatchEncoder --------------------------------------------------
+
+// Writes patches to a stream, one after another.
+type PatchEncoder struct {
+	w   io.Writer
+	crc hash.Hash32
+	buf []byte
+}
+
+func NewPatchEncoder(w io.Writer) *PatchEncoder {
+	return &PatchEncoder{w: w, crc: crc32.New(crcTable)}
+}
+
+func (e *PatchEncoder) Encode(p TxnPatch) error {
+	e.crc.Reset()
+	e.buf = append(e.buf[:0], patchMagic...)
+	e.buf = append(e.buf, patchVersion)
+	e.buf = appendUvarint(e.buf, uint64(len(p)))
+	for i := range p {
+		cell := &p[i]
+		e.buf = appendBytes(e.buf, []byte(cell.Bucket))
+		e.buf = appendBytes(e.buf, cell.Key)
+		var flags byte
+		if cell.Clear {
+			flags = cellClear
+		}
+		if cell.Prior != nil {
+			e.buf = appendState(e.buf, &cell.CellState, flags|cellPrior)
+			e.buf = appendState(e.buf, cell.Prior, 0)
+		} else {
+			e.buf = appendState(e.buf, &cell.CellState, flags)
+		}
+
+		// large patches are written piece by piece
+		if len(e.buf) >= 64<<10 {
+			if err := e.flush(); err != nil {
+				return err
+			}
+		}
+	}
+	e.crc.Write(e.buf)
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], e.crc.Sum32())
+	_, err := e.w.Write(append(e.buf, crc[:]...))
+	e.buf = e.buf[:0]
+	return err
+}
+
+func (e *PatchEncoder) flush() error {
+	e.crc.Write(e.buf)
+	_, err := e.w.Write(e.buf)
+	e.buf = e.buf[:0]
+	return err
+}
+
+func appendState(buf []byte, state *CellState, flags byte) []byte {
+	switch {
+	case flags&cellClear != 0: // the state of a clear cell is not used
+		buf = append(buf, flags)
+	case state.Exists && len(state.Values) > 0:
+		buf = append(buf, flags|cellExists|cellDups)
+		buf = appendUvarint(buf, uint64(len(state.Values)))
+		for _, dup := range state.Values {
+			buf = appendBytes(buf, dup)
+		}
+	case state.Exists && state.Values == nil:
+		buf = append(buf, flags|cellExists)
+		buf = appendBytes(buf, state.Value)
+	default: // including a DupSort state without values, see NewPutDupsCell
+		buf = append(buf, flags)
+	}
+	return buf
+}
+
+func appendUvarint(buf []byte, n uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutUvarint(b[:], n)]...)
+}
+
+func appendBytes(buf, b []byte) []byte {
+	buf = appendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+//--------------------------------- PatchDecoder --------------------------------------------------
+
+// Reads patches from a stream, one after another. Like json.Decoder, it may read beyond the last
+// patch decoded, unless the stream is an io.ByteReader.
+type PatchDecoder struct {
+	r       *hashingReader
+	version byte // of the patch being decoded
+}
+
+// Hashes everything read from {r}.
+type hashingReader struct {
+	r interface {
+		io.Reader
+		io.ByteReader
+	}
+	crc hash.Hash32
+}
+
+func (hr *hashingReader) Read(b []byte) (int, error) {
+	n, err := hr.r.Read(b)
+	hr.crc.Write(b[:n])
+	return n, err
+}
+
+func (hr *hashingReader) ReadByte() (byte, error) {
+	c, err := hr.r.ReadByte()
+	if err == nil {
+		hr.crc.Write([]byte{c})
+	}
+	return c, err
+}
+
+func NewPatchDecoder(r io.Reader) *PatchDecoder {
+	hr := &hashingReader{crc: crc32.New(crcTable)}
+	if br, ok := r.(interface {
+		io.Reader
+		io.ByteReader
+	}); ok {
+		hr.r = br
+	} else {
+		hr.r = bufio.NewReader(r)
+	}
+	return &PatchDecoder{r: hr}
+}
+
+// Returns io.EOF if the stream ends before the patch starts, else ErrCorruptedPatch if the patch
+// is not valid.
+func (d *PatchDecoder) Decode() (TxnPatch, error) {
+	d.r.crc.Reset()
+	magic := make([]byte, len(patchMagic))
+	n, err := io.ReadFull(d.r, magic)
+	if err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, d.readError(err)
+	} else if string(magic[:n]) != patchMagic {
+		return nil, corruptedPatch("bad magic %q", magic)
+	}
+	version, err := d.r.ReadByte()
+	if err != nil {
+		return nil, d.readError(err)
+	} else if version == 0 || version > patchVersion {
+		return nil, corruptedPatch("unknown version %d", version)
+	}
+	d.version = version
+
+	count, err := d.readLen()
+	if err != nil {
+		return nil, err
+	}
+	var patch TxnPatch
+	for i := uint64(0); i < count; i++ {
+		cell, err := d.readCell()
+		if err != nil {
+			return nil, err
+		}
+		patch = append(patch, cell)
+	}
+
+	sum := d.r.crc.Sum32()
+	var crc [4]byte
+	if _, err = io.ReadFull(d.r, crc[:]); err != nil {
+		return nil, d.readError(err)
+	} else if binary.BigEndian.Uint32(crc[:]) != sum {
+		return nil, corruptedPatch("checksum mismatch")
+	}
+	return patch, nil
+}
+
+func (d *PatchDecoder) readCell() (cell PatchCell, err error) {
+	bucket, err := d.readBytes()
+	if err != nil {
+		return
+	}
+	cell.Bucket = string(bucket)
+	if cell.Key, err = d.readBytes(); err != nil {
+		return
+	}
+	extra := byte(cellPrior | cellClear)
+	if d.version < 2 {
+		extra = cellPrior
+	}
+	flags, err := d.readState(&cell.CellState, extra)
+	if err != nil {
+		return
+	}
+	cell.Clear = flags&cellClear != 0
+	if d.version < 2 && cell.Key == nil {
+		cell.Clear, cell.CellState = true, CellState{}
+	}
+	if cell.Clear && cell.Key != nil {
+		return cell, corruptedPatch("clear cell with a key")
+	} else if !cell.Clear && cell.Key == nil {
+		return cell, corruptedPatch("cell without key")
+	}
+	if flags&cellPrior != 0 {
+		cell.Prior = &CellState{}
+		_, err = d.readState(cell.Prior, 0)
+	}
+	return
+}
+
+// Reads a state into {state}, returns which of the {extra} flags are set.
+func (d *PatchDecoder) readState(state *CellState, extra byte) (set byte, err error) {
+	flags, err := d.r.ReadByte()
+	if err != nil {
+		return 0, d.readError(err)
+	}
+	set = flags & extra
+	flags &^= extra
+	if set&cellClear != 0 && flags != 0 {
+		return 0, corruptedPatch("clear cell with flags %#x", flags)
+	}
+
+	switch flags {
+	case 0:
+	case cellExists:
+		state.Exists = true
+		state.Value, err = d.readBytes()
+	case cellExists | cellDups:
+		state.Exists = true
+		var n uint64
+		if n, err = d.readLen(); err != nil {
+			return
+		} else if n == 0 {
+			return 0, corruptedPatch("DupSort cell without values")
+		}
+		state.Values = [][]byte{}
+		for i := uint64(0); i < n; i++ {
+			dup, err := d.readBytes()
+			if err != nil {
+				return 0, err
+			}
+			state.Values = append(state.Values, dup)
+		}
+	default:
+		err = corruptedPatch("bad cell flags %#x", flags)
+	}
+	return
+}
+
+// A patch ending early is corrupted.
+func (d *PatchDecoder) readError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return corruptedPatch("truncated")
+	}
+	return err
+}
+
+func (d *PatchDecoder) readLen() (uint64, error) {
+	n, err := binary.ReadUvarint(d.r)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, d.readError(err)
+	} else if err != nil {
+		return 0, corruptedPatch("bad length: %v", err)
+	}
+	return n, nil
+}
+
+// Returns nil for empty bytes, like mdb.Val.Bytes.
+func (d *PatchDecoder) readBytes() ([]byte, error) {
+	n, err := d.readLen()
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	// the buffer grows with the data actually read, so a corrupted length can't exhaust memory
+	var buf bytes.Buffer
+	m, err := io.CopyN(&buf, d.r, int64(n))
+	if err == io.EOF || err == nil && uint64(m) != n {
+		return nil, corruptedPatch("truncated")
+	} else if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,178 @@
+package lmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+func makeCodecPatch(t *testing.T) TxnPatch {
+	path, db := openDupSortDb("lmdb_test")
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		txn.Put(testBucket, []byte("gone"), []byte("1"))
+		return nil
+	})
+	patch, err := MakePatch(db, func(txn *ReadWriteTxn) error {
+		txn.Put(testBucket, []byte("k"), []byte("v"))
+		txn.Put(testBucket, []byte("empty"), nil)
+		txn.Delete(testBucket, []byte("gone"))
+		txn.PutDup(dupBucket, []byte("d"), []byte("1"))
+		txn.PutDup(dupBucket, []byte("d"), []byte("2"))
+		txn.PutDup(dupBucket, []byte("x"), []byte("1"))
+		txn.DeleteDup(dupBucket, []byte("x"), []byte("1"))
+		return nil
+	})
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, len(patch), 5)
+	return patch
+}
+
+func TestPatchCodec(t *testing.T) {
+	patch := makeCodecPatch(t)
+
+	data, err := patch.MarshalBinary()
+	ensure.Nil(t, err)
+	var decoded TxnPatch
+	ensure.Nil(t, decoded.UnmarshalBinary(data))
+	ensure.DeepEqual(t, decoded, patch)
+
+	// identical changes, identical bytes
+	data2, err := makeCodecPatch(t).MarshalBinary()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, data2, data)
+
+	// several patches in a stream
+	var buf bytes.Buffer
+	enc := NewPatchEncoder(&buf)
+	ensure.Nil(t, enc.Encode(patch))
+	ensure.Nil(t, enc.Encode(nil))
+	ensure.Nil(t, enc.Encode(patch[:1]))
+	dec := NewPatchDecoder(&buf)
+	for _, expected := range []TxnPatch{patch, nil, patch[:1]} {
+		p, err := dec.Decode()
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, p, expected)
+	}
+	_, err = dec.Decode()
+	ensure.True(t, err == io.EOF)
+
+	// the decoded patch applies as the original one
+	path, db := openDupSortDb("lmdb_test")
+	defer os.RemoveAll(path)
+	defer db.Close()
+	ensure.Nil(t, db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		return txn.ApplyPatch(decoded)
+	}))
+	db.TransactionalR(func(txn ReadTxner) {
+		dups := txn.(DupSortReader).GetAll(dupBucket, []byte("d"))
+		ensure.DeepEqual(t, dups, [][]byte{[]byte("1"), []byte("2")})
+	})
+}
+
+func TestPatchCodec_Corrupted(t *testing.T) {
+	data, err := makeCodecPatch(t).MarshalBinary()
+	ensure.Nil(t, err)
+
+	var p TxnPatch
+	for i := range data {
+		corrupted := append([]byte{}, data...)
+		corrupted[i] ^= 0x10
+		ensure.True(t, errors.Is(p.UnmarshalBinary(corrupted), ErrCorruptedPatch))
+	}
+	for n := 1; n < len(data); n++ {
+		ensure.True(t, errors.Is(p.UnmarshalBinary(data[:n]), ErrCorruptedPatch))
+	}
+	ensure.True(t, errors.Is(p.UnmarshalBinary(append(data, 0)), ErrCorruptedPatch))
+	ensure.True(t, p == nil)
+}
+
+func TestPatchCodec_EmptyDups(t *testing.T) {
+	// encoded as the missing key it stands for, see NewPutDupsCell
+	empty := PatchCell{Bucket: dupBucket, Key: []byte("k"),
+		CellState: CellState{Exists: true, Values: [][]byte{}}}
+	data, err := TxnPatch{empty}.MarshalBinary()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, len(data), TxnPatch{empty}.SizeBytes())
+	var p TxnPatch
+	ensure.Nil(t, p.UnmarshalBinary(data))
+	ensure.DeepEqual(t, p, TxnPatch{NewDeleteCell(dupBucket, []byte("k"))})
+
+	// never written by the encoder
+	data = append([]byte(patchMagic), patchVersion, 1)
+	data = appendBytes(data, []byte(dupBucket))
+	data = appendBytes(data, []byte("k"))
+	data = append(data, cellExists|cellDups, 0)
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.Checksum(data, crcTable))
+	data = append(data, crc[:]...)
+	p = nil
+	ensure.True(t, errors.Is(p.UnmarshalBinary(data), ErrCorruptedPatch))
+	ensure.True(t, p == nil)
+}
+
+func TestPatchCodec_ClearCells(t *testing.T) {
+	// a cell with an empty key is not a clear cell, and vice versa
+	patch := TxnPatch{NewClearCell(testBucket), NewPutCell(testBucket, nil, []byte("v"))}
+	ensure.True(t, patch[0].IsClear())
+	ensure.False(t, patch[1].IsClear())
+	data, err := patch.MarshalBinary()
+	ensure.Nil(t, err)
+	var p TxnPatch
+	ensure.True(t, errors.Is(p.UnmarshalBinary(data), ErrCorruptedPatch))
+
+	data, err = TxnPatch{NewClearCell(testBucket), NewDeleteCell(testBucket, []byte("k"))}.
+		MarshalBinary()
+	ensure.Nil(t, err)
+	ensure.Nil(t, p.UnmarshalBinary(data))
+	ensure.DeepEqual(t, p, TxnPatch{NewClearCell(testBucket), NewDeleteCell(testBucket, []byte("k"))})
+
+	// never written by the encoder
+	encode := func(key []byte, flags byte) []byte {
+		data := append([]byte(patchMagic), patchVersion, 1)
+		data = appendBytes(data, []byte(testBucket))
+		data = appendBytes(data, key)
+		data = append(data, flags)
+		var crc [4]byte
+		binary.BigEndian.PutUint32(crc[:], crc32.Checksum(data, crcTable))
+		return append(data, crc[:]...)
+	}
+	ensure.Nil(t, p.UnmarshalBinary(encode(nil, cellClear)))
+	ensure.True(t, errors.Is(p.UnmarshalBinary(encode([]byte("k"), cellClear)), ErrCorruptedPatch))
+	ensure.True(t, errors.Is(p.UnmarshalBinary(encode(nil, 0)), ErrCorruptedPatch))
+	ensure.True(t, errors.Is(p.UnmarshalBinary(encode(nil, cellClear|cellExists)),
+		ErrCorruptedPatch))
+}
+
+func TestPatchCodec_Versions(t *testing.T) {
+	encode := func(version byte, key []byte, flags byte) []byte {
+		data := append([]byte(patchMagic), version, 1)
+		data = appendBytes(data, []byte(testBucket))
+		data = appendBytes(data, key)
+		data = append(data, flags)
+		var crc [4]byte
+		binary.BigEndian.PutUint32(crc[:], crc32.Checksum(data, crcTable))
+		return append(data, crc[:]...)
+	}
+	var p TxnPatch
+	ensure.Nil(t, p.UnmarshalBinary(encode(patchVersion, []byte("k"), 0)))
+	ensure.DeepEqual(t, p, TxnPatch{NewDeleteCell(testBucket, []byte("k"))})
+
+	// in version 1, a cell without key is a clear cell
+	ensure.Nil(t, p.UnmarshalBinary(encode(1, nil, 0)))
+	ensure.DeepEqual(t, p, TxnPatch{NewClearCell(testBucket)})
+	ensure.True(t, errors.Is(p.UnmarshalBinary(encode(1, nil, cellClear)), ErrCorruptedPatch))
+
+	for _, version := range []byte{0, patchVersion + 1} {
+		ensure.True(t, errors.Is(p.UnmarshalBinary(encode(version, []byte("k"), 0)),
+			ErrCorruptedPatch))
+	}
+}
@@ -0,0 +1,182 @@
+package lmdb
+
+import (
+	"bytes"
+	"sort"
+
+	mdb "github.com/libreoscar/gomdb"
+)
+
+// Read sets
+//
+// MakePatchWithReadSet records, besides the patch, what the txn read: the keys read with Get,
+// GetNoCopy, GetAll, CountDups etc. (point reads), and the ranges of keys visited by iterators.
+// An iterator positioned by a seek reads the keys from the sought key to the key it lands on
+// (with nothing in between), and extends that range as it moves with Next/Prev; reaching an end
+// of the bucket extends the range to that end. Two txns reading the same data see the same read
+// set, so it can be used to replay a txn deterministically, or to check that nothing it read has
+// changed since (optimistic concurrency).
+//
+// The reads of a nested txn are merged into its parent when it ends, even if it is rolled back:
+// its result depended on them all the same.
+
+// The keys and key ranges read by a txn, see "Read sets" in read_set.go.
+type ReadSet struct {
+	Keys   []CellKey  // sorted by bucket, then by the bytes of the keys
+	Ranges []KeyRange // in the order of the reads, overlapping ranges are not merged
+}
+
+// The keys of {Bucket} from {Start} to {End} included, in the order of the bucket. A nil Start
+// (End) extends the range to the first (last) key of the bucket.
+type KeyRange struct {
+	Bucket     string
+	Start, End []byte
+}
+
+func (rs *ReadSet) IsEmpty() bool {
+	return len(rs.Keys) == 0 && len(rs.Ranges) == 0
+}
+
+// Reads of a txn, nil if they are not tracked.
+type readSet struct {
+	keys   map[string]struct{} // encoded CellKeys
+	ranges []KeyRange
+	keyBuf []byte // to encode the CellKeys without allocating
+}
+
+func newReadSet() *readSet {
+	return &readSet{keys: make(map[string]struct{})}
+}
+
+// A read set for a nested txn of a txn with {rs}, nil if {rs} is nil.
+func (rs *readSet) child() *readSet {
+	if rs == nil {
+		return nil
+	}
+	return newReadSet()
+}
+
+func (rs *readSet) merge(child *readSet) {
+	if rs == nil || child == nil {
+		return
+	}
+	for key := range child.keys {
+		rs.keys[key] = struct{}{}
+	}
+	rs.ranges = append(rs.ranges, child.ranges...)
+}
+
+func (rs *readSet) recordKey(bucket string, key []byte) {
+	if rs == nil {
+		return
+	}
+	rs.keyBuf = CellKey{bucket, key}.AppendEncoded(rs.keyBuf[:0])
+	if _, ok := rs.keys[string(rs.keyBuf)]; !ok {
+		rs.keys[string(rs.keyBuf)] = struct{}{}
+	}
+}
+
+// Returns the index of the new range.
+func (rs *readSet) recordRange(bucket string, start, end []byte) int {
+	rs.ranges = append(rs.ranges, KeyRange{bucket, copyBytes(start), copyBytes(end)})
+	return len(rs.ranges) - 1
+}
+
+func (rs *readSet) export() *ReadSet {
+	rst := &ReadSet{Ranges: rs.ranges}
+	for key := range rs.keys {
+		ck, err := DecodeCellKey(key)
+		if err != nil {
+			panic(err) // encoded by recordKey
+		}
+		rst.Keys = append(rst.Keys, ck)
+	}
+	// not by the encoded keys, which sort by the length of the bucket first
+	sort.Slice(rst.Keys, func(i, j int) bool {
+		a, b := rst.Keys[i], rst.Keys[j]
+		if a.Bucket != b.Bucket {
+			return a.Bucket < b.Bucket
+		}
+		return bytes.Compare(a.Key, b.Key) < 0
+	})
+	return rst
+}
+
+// Keeps nil as nil, see KeyRange.
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+//--------------------------------- Iterator ------------------------------------------------------
+
+// The current key, nil if the iterator is not positioned.
+func (itr *iterState) currentKey() []byte {
+	if itr.overlay != nil {
+		return itr.overlay.key
+	}
+	key, _, err := itr.cur.GetVal(nil, nil, mdb.GET_CURRENT)
+	if err != nil {
+		return nil
+	}
+	return key.BytesNoCopy()
+}
+
+// Records the range read by a seek from {from} (nil if from the first key), which landed on the
+// current key if {ok}. {last} is the seek to the last key.
+func (itr *iterState) recordSeek(from []byte, ok, last bool) {
+	if itr.reads == nil {
+		return
+	}
+	switch {
+	case !ok && last:
+		itr.span = itr.reads.recordRange(itr.bucket, nil, nil)
+	case !ok:
+		itr.span = itr.reads.recordRange(itr.bucket, from, nil)
+	case last:
+		itr.span = itr.reads.recordRange(itr.bucket, itr.currentKey(), nil)
+	default:
+		itr.span = itr.reads.recordRange(itr.bucket, from, itr.currentKey())
+	}
+}
+
+// Records the key {k} read by a seek to one of its values, which landed on it if {ok}.
+func (itr *iterState) recordSeekKey(k []byte, ok bool) {
+	if itr.reads == nil {
+		return
+	} else if ok {
+		itr.span = itr.reads.recordRange(itr.bucket, k, k)
+	} else {
+		itr.reads.recordKey(itr.bucket, k)
+	}
+}
+
+// Records the range read by moving from {prev} (the key before the move) to the next (previous
+// if {backward}) key, which is the current key if {ok}.
+func (itr *iterState) recordStep(prev []byte, ok, backward bool) {
+	if itr.reads == nil {
+		return
+	}
+	var key []byte // nil: the end of the bucket is reached
+	if ok {
+		key = itr.currentKey()
+	}
+	if itr.span < 0 || prev == nil {
+		if backward {
+			itr.span = itr.reads.recordRange(itr.bucket, key, prev)
+		} else {
+			itr.span = itr.reads.recordRange(itr.bucket, prev, key)
+		}
+		return
+	}
+
+	// {prev} is in the current range, the range grows only if {prev} is at its edge
+	rng := &itr.reads.ranges[itr.span]
+	if backward && rng.Start != nil && bytes.Equal(rng.Start, prev) {
+		rng.Start = copyBytes(key)
+	} else if !backward && rng.End != nil && bytes.Equal(rng.End, prev) {
+		rng.End = copyBytes(key)
+	}
+}
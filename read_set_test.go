@@ -0,0 +1,77 @@
+package lmdb
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestReadSet(t *testing.T) {
+	path, db := openDupSortDb("lmdb_test")
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		for _, k := range []string{"a", "b", "c", "d", "e"} {
+			txn.Put(testBucket, []byte(k), []byte(k))
+		}
+		txn.PutDup(dupBucket, []byte("d"), []byte("1"))
+		return nil
+	})
+
+	tx := func(txn *ReadWriteTxn) error {
+		txn.Get(testBucket, []byte("x"))
+		txn.GetNoCopy(testBucket, []byte("a"))
+		txn.CountDups(dupBucket, []byte("d"))
+
+		itr := txn.Iterate(testBucket)
+		itr.Next()
+		itr.Next()
+		itr.Prev() // inside the range
+		itr.SeekGE([]byte("ca"))
+		itr.Next()
+		itr.Next() // end of the bucket
+
+		txn.Put(testBucket, []byte("z"), []byte("z"))
+		txn.TransactionalRW(func(txn *ReadWriteTxn) error {
+			txn.Get(testBucket, []byte("n"))
+			return errors.New("rolled back")
+		})
+		return nil
+	}
+
+	patch, reads, err := MakePatchWithReadSet(db, tx, false)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, patch, TxnPatch{NewPutCell(testBucket, []byte("z"), []byte("z"))})
+	ensure.DeepEqual(t, reads.Keys, []CellKey{
+		{testBucket, []byte("a")},
+		{testBucket, []byte("n")},
+		{testBucket, []byte("x")},
+		{dupBucket, []byte("d")},
+	})
+	ensure.DeepEqual(t, reads.Ranges, []KeyRange{
+		{testBucket, nil, []byte("c")},
+		{testBucket, []byte("ca"), nil},
+	})
+
+	// the reads of a patch made in a txn are reads of the txn
+	_, outer, err := MakePatchWithReadSet(db, func(txn *ReadWriteTxn) error {
+		txn.Get(testBucket, []byte("y"))
+		_, err := MakePatch(txn, tx)
+		return err
+	}, true)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, len(outer.Keys), 5)
+	ensure.DeepEqual(t, outer.Ranges, reads.Ranges)
+
+	// an empty bucket is read entirely
+	_, reads, err = MakePatchWithReadSet(db, func(txn *ReadWriteTxn) error {
+		txn.ClearBucket(testBucket)
+		ensure.True(t, txn.IsBucketEmpty(testBucket))
+		return nil
+	}, false)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, reads, &ReadSet{Ranges: []KeyRange{{testBucket, nil, nil}}})
+}
@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/facebookgo/ensure"
+	mdb "github.com/libreoscar/gomdb"
 )
 
 func TestDryRunTx(t *testing.T) {
@@ -106,3 +107,89 @@ func TestIsBucketEmpty(t *testing.T) {
 		return nil
 	})
 }
+
+func TestTryMethods(t *testing.T) {
+	path, err := ioutil.TempDir("", "lmdb_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(path)
+
+	db, err := Open(path, []string{"bucket"})
+	defer db.Close()
+	if err != nil {
+		panic(err)
+	}
+
+	tooLargeKey := make([]byte, 4096)
+	err = db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		ensure.Nil(t, txn.TryPut("bucket", []byte("foo"), []byte("bar")))
+		ensure.NotNil(t, txn.TryPut("non-existing-bucket", []byte("foo"), []byte("bar")))
+
+		_, _, err := txn.TryGet("non-existing-bucket", []byte("foo"))
+		ensure.NotNil(t, err)
+		_, err = txn.TryIterate("non-existing-bucket")
+		ensure.NotNil(t, err)
+
+		itr, err := txn.TryIterate("bucket")
+		ensure.Nil(t, err)
+		_, err = itr.TrySeekGE(nil)
+		ensure.NotNil(t, err)
+		ok, err := itr.TrySeekGE([]byte("f"))
+		ensure.Nil(t, err)
+		ensure.True(t, ok)
+
+		return txn.TryPut("bucket", tooLargeKey, []byte("bar"))
+	})
+	ensure.NotNil(t, err)
+
+	// the failed txn is rolled back
+	err = db.TryTransactionalR(func(txn ReadTxner) error {
+		_, exist, err := txn.(TryReadTxner).TryGet("bucket", []byte("foo"))
+		ensure.False(t, exist)
+		return err
+	})
+	ensure.Nil(t, err)
+}
+
+func TestIteratorCursor(t *testing.T) {
+	path, err := ioutil.TempDir("", "lmdb_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(path)
+
+	db, err := Open(path, []string{"bucket"})
+	defer db.Close()
+	if err != nil {
+		panic(err)
+	}
+
+	db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		txn.Put("bucket", []byte("a"), []byte("1"))
+		txn.Put("bucket", []byte("b"), []byte("2"))
+
+		// an Iterator converts to its cursor and back
+		cur := (*mdb.Cursor)(txn.Iterate("bucket"))
+		key, _, err := cur.Get(nil, nil, mdb.GET_CURRENT)
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, key, []byte("a"))
+
+		itr := (*Iterator)(cur)
+		ensure.True(t, itr.Next())
+		key, val := itr.Get()
+		ensure.DeepEqual(t, key, []byte("b"))
+		ensure.DeepEqual(t, val, []byte("2"))
+		ensure.False(t, itr.SeekExact([]byte("c")))
+
+		// so does a cursor opened by the caller
+		cur, err = txn.txn.CursorOpen(txn.getBucketId("bucket"))
+		ensure.Nil(t, err)
+		itr = (*Iterator)(cur)
+		defer itr.Close()
+		ensure.True(t, itr.SeekLast())
+		key, _ = itr.Get()
+		ensure.DeepEqual(t, key, []byte("b"))
+		return nil
+	})
+}
@@ -0,0 +1,149 @@
+package lmdb
+
+import (
+	"log"
+	"runtime"
+
+	mdb "github.com/libreoscar/gomdb"
+)
+
+// Read txn pool
+//
+// The top-level read txns of TransactionalR and of the read handles are not aborted when they
+// end, but reset (mdb_txn_reset) and kept in Database.readPool, up to the pool size (see
+// WithReadPoolSize), to be renewed (mdb_txn_renew) by the next read txn, which saves allocating
+// the txn and taking a reader slot. A reset txn holds no snapshot, but it keeps its reader slot,
+// so the pool is smaller than the max number of readers. MDB_NOTLS lets a pooled txn be renewed
+// by any goroutine.
+//
+// Snapshots
+//
+// A Snapshot is a read txn held across calls, and moved to the last committed state on demand
+// by Refresh, which resets and renews the same txn. As with read handles (see handle.go), it
+// must be closed, and it prevents the pages of its state from being reused until then; a snapshot
+// garbage collected before it is closed is reported, but not closed. Map resizes wait for an open
+// snapshot to be refreshed or closed (see map_size.go).
+
+const READ_POOL_SIZE_DEFAULT int = 16
+
+// Begins a top-level read txn, registered in activeTxns, renewing a pooled txn if there is one.
+func (db *Database) beginReadTxn() (*mdb.Txn, error) {
+	db.poolMu.Lock()
+	var txn *mdb.Txn
+	if n := len(db.readPool); n > 0 {
+		txn = db.readPool[n-1]
+		db.readPool = db.readPool[:n-1]
+	}
+	db.poolMu.Unlock()
+
+	if txn != nil {
+		db.enterTxn()
+		if txn.Renew() == nil {
+			return txn, nil
+		}
+		// e.g. MDB_MAP_RESIZED, adopted by beginTxn
+		txn.Abort()
+		db.exitTxn()
+	}
+	txn, _, err := db.beginTxn(mdb.RDONLY)
+	return txn, err
+}
+
+// Ends a top-level read txn begun by beginReadTxn, keeping it in the pool if there is room.
+// Its cursors must be closed. {held}: the txn was moved to heldTxns.
+func (db *Database) endReadTxn(txn *mdb.Txn, held bool) {
+	txn.Reset()
+	if held {
+		db.exitHeldTxn()
+	} else {
+		db.exitTxn()
+	}
+
+	db.poolMu.Lock()
+	if !db.closed && len(db.readPool) < db.readPoolSize {
+		db.readPool = append(db.readPool, txn)
+		txn = nil
+	}
+	db.poolMu.Unlock()
+	if txn != nil {
+		txn.Abort()
+	}
+}
+
+// Aborts the pooled txns, and stops pooling. Called by Close.
+func (db *Database) drainReadPool() {
+	db.poolMu.Lock()
+	pool := db.readPool
+	db.readPool, db.closed = nil, true
+	db.poolMu.Unlock()
+	for _, txn := range pool {
+		txn.Abort()
+	}
+}
+
+//--------------------------------- Snapshot ------------------------------------------------------
+
+// A read txn that can be held across calls and refreshed, see "Snapshots" in snapshot.go.
+type Snapshot struct {
+	*ReadTxn // nil once closed
+	begun    string
+}
+
+// Errors from beginning the txn are returned.
+func (db *Database) Snapshot() (*Snapshot, error) {
+	gen := db.bucketGeneration()
+	txn, err := db.beginReadTxn()
+	if err != nil { // Possible Errors: MDB_PANIC, MDB_READERS_FULL, ENOMEM
+		return nil, wrapError("begin read txn", "", nil, err)
+	}
+	db.holdTxn()
+	rdTxn := &ReadTxn{db: db, txn: txn, held: true, bucketGen: gen}
+	s := &Snapshot{ReadTxn: rdTxn, begun: db.beginSite()}
+	runtime.SetFinalizer(s, (*Snapshot).leaked)
+	return s, nil
+}
+
+// Moves the snapshot to the last committed state. Its iterators are closed. If the txn cannot be
+// renewed, a new one is begun; if that fails too, the snapshot is closed and the error returned.
+// Returns ErrTxnFinished if the snapshot is closed already.
+func (s *Snapshot) Refresh() error {
+	if s.ReadTxn == nil {
+		return wrapError("refresh snapshot", "", nil, ErrTxnFinished)
+	}
+	s.closeIterators(0)
+	s.endNoCopies()
+	s.txn.Reset()
+	// the reset txn does not hold the map, so a pending resize goes first, see map_size.go
+	s.db.exitHeldTxn()
+	s.bucketGen = s.db.bucketGeneration()
+	s.db.enterTxn()
+	if s.txn.Renew() != nil {
+		// e.g. MDB_MAP_RESIZED, which beginTxn adopts once this txn is unregistered
+		s.txn.Abort()
+		s.db.exitTxn()
+		txn, _, err := s.db.beginTxn(mdb.RDONLY)
+		if err != nil {
+			runtime.SetFinalizer(s, nil)
+			s.ReadTxn = nil
+			return wrapError("refresh snapshot", "", nil, err)
+		}
+		s.txn = txn
+	}
+	s.db.holdTxn()
+	return nil
+}
+
+// Ends the txn, closing its iterators. No-op if the snapshot is closed already.
+func (s *Snapshot) Close() {
+	if s.ReadTxn == nil {
+		return
+	}
+	runtime.SetFinalizer(s, nil)
+	txn := s.ReadTxn
+	s.ReadTxn = nil
+	txn.end()
+}
+
+func (s *Snapshot) leaked() {
+	log.Printf("[ERROR] A snapshot was never closed, its txn is kept.%s", s.begun)
+}
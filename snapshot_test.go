@@ -0,0 +1,149 @@
+package lmdb
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestReadPool(t *testing.T) {
+	path, err := ioutil.TempDir("", "lmdb_test")
+	ensure.Nil(t, err)
+	defer os.RemoveAll(path)
+	db, err := Open(path, []string{testBucket}, WithReadPoolSize(2))
+	ensure.Nil(t, err)
+
+	get := func() (v []byte) {
+		db.TransactionalR(func(txn ReadTxner) {
+			v, _ = txn.Get(testBucket, []byte("a"))
+		})
+		return
+	}
+	poolSize := func() int {
+		db.poolMu.Lock()
+		defer db.poolMu.Unlock()
+		return len(db.readPool)
+	}
+
+	ensure.True(t, get() == nil)
+	ensure.DeepEqual(t, poolSize(), 1)
+	// a renewed txn sees the last committed state
+	db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		txn.Put(testBucket, []byte("a"), []byte("1"))
+		return nil
+	})
+	ensure.DeepEqual(t, get(), []byte("1"))
+	ensure.DeepEqual(t, poolSize(), 1)
+
+	var handles []*ReadHandle
+	for i := 0; i < 3; i++ {
+		h, err := db.BeginRead()
+		ensure.Nil(t, err)
+		handles = append(handles, h)
+	}
+	ensure.DeepEqual(t, poolSize(), 0)
+	for _, h := range handles {
+		h.Abort()
+	}
+	ensure.DeepEqual(t, poolSize(), 2)
+
+	db.Close() // aborts the pooled txns
+	ensure.DeepEqual(t, poolSize(), 0)
+}
+
+func TestSnapshot(t *testing.T) {
+	path, db := openDupSortDb("lmdb_test")
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	put := func(v string) {
+		ensure.Nil(t, db.TransactionalRW(func(txn *ReadWriteTxn) error {
+			txn.Put(testBucket, []byte("a"), []byte(v))
+			return nil
+		}))
+	}
+	put("1")
+
+	s, err := db.Snapshot()
+	ensure.Nil(t, err)
+	defer s.Close()
+	itr := s.Iterate(testBucket)
+	ensure.NotNil(t, itr)
+	put("2")
+
+	// the snapshot may be used by another goroutine
+	done := make(chan []byte)
+	go func() {
+		v, _ := s.Get(testBucket, []byte("a"))
+		done <- v
+	}()
+	ensure.DeepEqual(t, <-done, []byte("1"))
+	_, v := itr.Get()
+	ensure.DeepEqual(t, v, []byte("1"))
+
+	ensure.Nil(t, s.Refresh())
+	ensure.DeepEqual(t, len(s.itrs), 0)
+	v, _ = s.Get(testBucket, []byte("a"))
+	ensure.DeepEqual(t, v, []byte("2"))
+	put("3")
+	v, _ = s.Get(testBucket, []byte("a"))
+	ensure.DeepEqual(t, v, []byte("2"))
+
+	s.Close()
+	s.Close() // no-op
+	ensure.True(t, errors.Is(s.Refresh(), ErrTxnFinished))
+	db.txnsMu.Lock()
+	ensure.DeepEqual(t, db.activeTxns, 0)
+	db.txnsMu.Unlock()
+}
+
+// An unclosed snapshot is reported when garbage collected, but its iterators still work.
+func TestSnapshot_Leak(t *testing.T) {
+	path, db := openDupSortDb("lmdb_test")
+	defer os.RemoveAll(path)
+	defer db.Close()
+	db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		txn.Put(testBucket, []byte("a"), []byte("1"))
+		return nil
+	})
+
+	var mu sync.Mutex
+	var buf bytes.Buffer
+	log.SetOutput(writerFunc(func(p []byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return buf.Write(p)
+	}))
+	defer log.SetOutput(os.Stderr)
+	logged := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return buf.String()
+	}
+
+	var itr *Iterator
+	func() {
+		s, err := db.Snapshot()
+		ensure.Nil(t, err)
+		itr = s.Iterate(testBucket)
+	}()
+	for i := 0; i < 100 && logged() == ""; i++ {
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+	}
+	ensure.True(t, strings.Contains(logged(), "snapshot was never closed"), logged())
+	_, v := itr.Get()
+	ensure.DeepEqual(t, v, []byte("1"))
+	db.txnsMu.Lock()
+	ensure.DeepEqual(t, db.heldTxns, 1)
+	db.txnsMu.Unlock()
+}
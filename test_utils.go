@@ -19,7 +19,7 @@ func MakePatchOfDb(db *Database) (rst TxnPatch) {
 
 			for {
 				key, val := itr.Get()
-				rst = append(rst, cellState{bucket, key, true, val})
+				rst = append(rst, NewPutCell(bucket, key, val))
 				if !itr.Next() {
 					break
 				}
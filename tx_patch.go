@@ -1,10 +1,260 @@
 package lmdb
 
-type cellState struct {
-	bucket string
-	key    []byte
-	exists bool
-	value  []byte
+import (
+	"bytes"
+	"sort"
+)
+
+// The state of a key. For DupSort buckets, {Values} holds all the values of the key (nil if the
+// key does not exist), and {Value} is not used.
+type CellState struct {
+	Exists bool
+	Value  []byte
+	Values [][]byte
+}
+
+func (s *CellState) equal(other *CellState) bool {
+	if s.Exists != other.Exists {
+		return false
+	} else if !s.Exists {
+		return true
+	}
+	if (s.Values == nil) != (other.Values == nil) || len(s.Values) != len(other.Values) {
+		return false
+	}
+	for i := range s.Values {
+		if !bytes.Equal(s.Values[i], other.Values[i]) {
+			return false
+		}
+	}
+	return bytes.Equal(s.Value, other.Value)
+}
+
+// The state of a key after a txn, and before it for reversible patches (see MakeReversiblePatch).
+//
+// A clear cell (see NewClearCell) clears the bucket: it deletes all the keys the bucket had
+// before the cells after it. It has no key, its CellState is not used, and its Prior is empty in
+// reversible patches, as the prior states of the keys cleared are recorded by cells of their own.
+// The other cells must have a key.
+type PatchCell struct {
+	Bucket string
+	Key    []byte
+	CellState
+	Prior *CellState // nil if the patch is not reversible
+	Clear bool       // set by NewClearCell only
+}
+
+// A cell setting {key} to {value}.
+func NewPutCell(bucket string, key, value []byte) PatchCell {
+	return PatchCell{Bucket: bucket, Key: key, CellState: CellState{Exists: true, Value: value}}
+}
+
+// A cell of a DupSort bucket setting the values of {key} to {values}, which must be sorted as in
+// the bucket. Without values, the key is deleted.
+func NewPutDupsCell(bucket string, key []byte, values ...[]byte) PatchCell {
+	if len(values) == 0 {
+		return NewDeleteCell(bucket, key)
+	}
+	return PatchCell{Bucket: bucket, Key: key, CellState: CellState{Exists: true, Values: values}}
+}
+
+// A cell deleting {key}.
+func NewDeleteCell(bucket string, key []byte) PatchCell {
+	return PatchCell{Bucket: bucket, Key: key}
+}
+
+// A cell clearing {bucket}.
+func NewClearCell(bucket string) PatchCell {
+	return PatchCell{Bucket: bucket, Clear: true}
+}
+
+func (cell *PatchCell) IsClear() bool {
+	return cell.Clear
+}
+
+func (cell *PatchCell) Deleted() bool {
+	return !cell.Exists
+}
+
+func (cell *PatchCell) CellKey() CellKey {
+	return CellKey{cell.Bucket, cell.Key}
+}
+
+// The cells of a TxnPatch made by MakePatch are in canonical order: sorted by bucket, then by key,
+// both compared as byte strings (even in IntegerKey buckets), with one cell per
+// (bucket, key). So the same changes to the same database always make the same patch. The clear
+// cell of a bucket, if any, comes first among the cells of the bucket.
+//
+// The methods returning patches share the cells (and their bytes) with the original patch.
+type TxnPatch []PatchCell
+
+func compareCells(a, b *PatchCell) int {
+	if a.Bucket != b.Bucket {
+		if a.Bucket < b.Bucket {
+			return -1
+		}
+		return 1
+	}
+	if a.Clear != b.Clear {
+		if a.Clear {
+			return -1
+		}
+		return 1
+	}
+	return bytes.Compare(a.Key, b.Key)
+}
+
+// Sorts the cells in canonical order. As the clear cell of a bucket comes first once sorted, Sort
+// rewrites the cells of the bucket which come before a clear cell into deletes, keeping their
+// prior states, so that the patch still applies the same changes. The cells of the same
+// (bucket, key) keep their order, so the result may still not be canonical.
+func (p TxnPatch) Sort() {
+	cleared := make(map[string]bool)
+	for i := len(p) - 1; i >= 0; i-- {
+		if p[i].IsClear() {
+			cleared[p[i].Bucket] = true
+		} else if cleared[p[i].Bucket] {
+			p[i].CellState = CellState{}
+		}
+	}
+	p.sortCells()
 }
 
-type TxnPatch []cellState
+// Sorts the cells in canonical order, keeping the order of the cells of the same (bucket, key).
+// Unlike Sort, the clear cells are assumed to apply before the key cells of their bucket.
+func (p TxnPatch) sortCells() {
+	sort.SliceStable(p, func(i, j int) bool {
+		return compareCells(&p[i], &p[j]) < 0
+	})
+}
+
+func (p TxnPatch) IsCanonical() bool {
+	for i := 1; i < len(p); i++ {
+		if compareCells(&p[i-1], &p[i]) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Number of cells.
+func (p TxnPatch) Len() int {
+	return len(p)
+}
+
+// The buckets changed by the patch, sorted.
+func (p TxnPatch) Buckets() []string {
+	seen := make(map[string]bool)
+	var buckets []string
+	for i := range p {
+		if !seen[p[i].Bucket] {
+			seen[p[i].Bucket] = true
+			buckets = append(buckets, p[i].Bucket)
+		}
+	}
+	sort.Strings(buckets)
+	return buckets
+}
+
+// The cells for which {keep} returns true, in the same order.
+func (p TxnPatch) Filter(keep func(cell *PatchCell) bool) TxnPatch {
+	var rst TxnPatch
+	for i := range p {
+		if keep(&p[i]) {
+			rst = append(rst, p[i])
+		}
+	}
+	return rst
+}
+
+// The cells of {bucket}.
+func (p TxnPatch) InBucket(bucket string) TxnPatch {
+	return p.Filter(func(cell *PatchCell) bool {
+		return cell.Bucket == bucket
+	})
+}
+
+// Calls {f} on each cell in order, stops at, and returns, the first error.
+func (p TxnPatch) ForEach(f func(cell *PatchCell) error) error {
+	for i := range p {
+		if err := f(&p[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The patch undoing {p}, which must be reversible: applied after {p}, it restores the state before
+// {p}. The inverse is canonical and reversible as well, its inverse has the same effect as {p}.
+// Fails with ErrNotReversible if a cell has no prior state.
+func (p TxnPatch) Inverse() (TxnPatch, error) {
+	index := make(map[string]int) // encoded CellKey -> index in {inv}
+	var inv TxnPatch
+	for i := range p {
+		cell := &p[i]
+		if cell.Prior == nil {
+			return nil, &Error{"inverse patch", cell.Bucket, cell.Key, ErrNotReversible}
+		} else if cell.IsClear() {
+			continue // undone by the cells of the keys cleared
+		}
+
+		state := cell.CellState
+		ck := cell.CellKey().Encode()
+		if j, ok := index[ck]; ok {
+			inv[j].Prior = &state // the state after the last change
+			continue
+		}
+		index[ck] = len(inv)
+		inv = append(inv, PatchCell{Bucket: cell.Bucket, Key: cell.Key, CellState: *cell.Prior,
+			Prior: &state})
+	}
+	inv.sortCells()
+	return inv, nil
+}
+
+// The patch with the same effect as applying {patches} in order: for each key, the state set by
+// its last cell, and the prior state recorded by its first cell (if any). A clear cell deletes
+// the keys of its bucket set by the cells before it. The result is canonical.
+func SquashPatches(patches ...TxnPatch) TxnPatch {
+	index := make(map[string]int) // encoded CellKey -> index in {rst}
+	var rst TxnPatch
+	for _, p := range patches {
+		for i := range p {
+			if p[i].IsClear() {
+				for j := range rst {
+					if rst[j].Bucket == p[i].Bucket {
+						rst[j].CellState = CellState{}
+					}
+				}
+			}
+
+			ck := p[i].CellKey().Encode()
+			if j, ok := index[ck]; ok {
+				rst[j].CellState = p[i].CellState
+				continue
+			}
+			index[ck] = len(rst)
+			rst = append(rst, p[i])
+		}
+	}
+	rst.sortCells()
+	return rst.dropClearedDeletes()
+}
+
+// Drops the cells of the canonical {p} which delete a key already deleted by the clear cell of
+// its bucket, and which have no prior state to restore.
+func (p TxnPatch) dropClearedDeletes() TxnPatch {
+	cleared := ""
+	return p.Filter(func(cell *PatchCell) bool {
+		if cell.IsClear() {
+			cleared = cell.Bucket
+			return true
+		}
+		return cell.Bucket != cleared || cell.Exists || cell.Prior != nil && cell.Prior.Exists
+	})
+}
+
+// Same as SquashPatches(p, later).
+func (p TxnPatch) Compose(later TxnPatch) TxnPatch {
+	return SquashPatches(p, later)
+}
@@ -17,6 +17,33 @@ func TestCellKey(tc *testing.T) {
 	ensure.DeepEqual(tc, deserialized, cellKey)
 }
 
+func TestCellKey_Encode(tc *testing.T) {
+	for _, cellKey := range []CellKey{
+		{"abce", []byte("987654321")},
+		{"", []byte("k")},
+		{"abce", nil},
+		{string(make([]byte, 200)), []byte{0, 0xff}},
+	} {
+		decoded, err := DecodeCellKey(cellKey.Encode())
+		ensure.Nil(tc, err)
+		ensure.DeepEqual(tc, decoded, cellKey)
+	}
+
+	// same order as the keys in a bucket
+	ensure.True(tc, CellKey{"b", []byte("a")}.Encode() < CellKey{"b", []byte("a0")}.Encode())
+	ensure.True(tc, CellKey{"b", []byte("a0")}.Encode() < CellKey{"b", []byte("b")}.Encode())
+	ensure.True(tc, CellKey{"b", nil}.Encode() < CellKey{"b", []byte{0}}.Encode())
+
+	for _, bad := range []string{"", "\x05abc", "\x80",
+		"\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01abc",     // length 1<<64-1
+		"\xff\xff\xff\xff\xff\xff\xff\xff\xff\x02abc",     // length overflowing uint64
+		"\x80\x80\x80\x80\x80\x80\x80\x80\x80\x80\x00abc", // uvarint longer than 10 bytes
+	} {
+		_, err := DecodeCellKey(bad)
+		ensure.NotNil(tc, err)
+	}
+}
+
 func makeTestRWTX(buckets []string, failAtTheEnd bool) func(*ReadWriteTxn) error {
 	return func(txn *ReadWriteTxn) error {
 		for _, bucket := range buckets {
@@ -115,3 +142,431 @@ func TestTxnPatch_FailedTx(tc *testing.T) {
 
 	ensure.DeepEqual(tc, MakePatchOfDb(dbTxn), MakePatchOfDb(dbPatch))
 }
+
+func TestTxnPatch_Canonical(tc *testing.T) {
+	buckets := []string{"b", "a"}
+	path, db := makeTestDb("lmdb_test", buckets)
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	keys := []string{"k3", "k1", "k2", "k0"}
+	var patches []TxnPatch
+	for i := 0; i < 5; i++ {
+		patch, err := MakePatch(db, func(txn *ReadWriteTxn) error {
+			for j := range keys {
+				key := keys[(i+j)%len(keys)]
+				txn.Put(buckets[(i+j)%2], []byte(key), []byte("v"))
+				txn.Delete(buckets[(i+j+1)%2], []byte(key))
+			}
+			return nil
+		})
+		ensure.Nil(tc, err)
+		ensure.True(tc, patch.IsCanonical())
+		patches = append(patches, patch)
+	}
+	for _, patch := range patches[1:] {
+		ensure.DeepEqual(tc, patch, patches[0])
+	}
+	ensure.DeepEqual(tc, len(patches[0]), 8)
+	ensure.DeepEqual(tc, patches[0][0].Bucket, "a")
+	ensure.DeepEqual(tc, string(patches[0][0].Key), "k0")
+
+	shuffled := TxnPatch{patches[0][5], patches[0][2], patches[0][7], patches[0][0]}
+	ensure.False(tc, shuffled.IsCanonical())
+	shuffled.Sort()
+	ensure.True(tc, shuffled.IsCanonical())
+	ensure.DeepEqual(tc, shuffled,
+		TxnPatch{patches[0][0], patches[0][2], patches[0][5], patches[0][7]})
+
+	dup := TxnPatch{patches[0][0], patches[0][0]}
+	ensure.False(tc, dup.IsCanonical())
+}
+
+func TestTxnPatch_SortClear(tc *testing.T) {
+	patch := TxnPatch{
+		NewPutCell(testBucket, []byte("k"), []byte("1")),
+		NewPutCell(testBucket, []byte("m"), []byte("1")),
+		NewPutCell("other", []byte("d"), []byte("1")),
+		NewClearCell(testBucket),
+		NewPutCell(testBucket, []byte("m"), []byte("2")),
+	}
+	sorted := append(TxnPatch(nil), patch...)
+	sorted.Sort()
+	// the cells before the clear cell of their bucket delete their keys
+	ensure.DeepEqual(tc, sorted, TxnPatch{
+		NewClearCell(testBucket),
+		NewDeleteCell(testBucket, []byte("k")),
+		NewDeleteCell(testBucket, []byte("m")),
+		NewPutCell(testBucket, []byte("m"), []byte("2")),
+		NewPutCell("other", []byte("d"), []byte("1")),
+	})
+
+	var states []TxnPatch
+	for _, p := range []TxnPatch{patch, sorted} {
+		path, err := ioutil.TempDir("", "lmdb_test")
+		ensure.Nil(tc, err)
+		defer os.RemoveAll(path)
+		db, err := Open(path, []string{testBucket, "other"})
+		ensure.Nil(tc, err)
+		defer db.Close()
+
+		db.TransactionalRW(func(txn *ReadWriteTxn) error {
+			txn.Put(testBucket, []byte("a"), []byte("0"))
+			return nil
+		})
+		ensure.Nil(tc, db.TransactionalRW(func(txn *ReadWriteTxn) error {
+			return txn.ApplyPatch(p)
+		}))
+		states = append(states, MakePatchOfDb(db))
+	}
+	ensure.DeepEqual(tc, states[1], states[0])
+	ensure.DeepEqual(tc, len(states[0]), 2) // d and m
+}
+
+func TestTxnPatch_Cells(tc *testing.T) {
+	path, db := openDupSortDb("lmdb_test")
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		txn.Put(testBucket, []byte("old"), []byte("1"))
+		txn.PutDup(dupBucket, []byte("d"), []byte("9"))
+		return nil
+	})
+
+	patch := TxnPatch{
+		NewPutCell(testBucket, []byte("new"), []byte("2")),
+		NewDeleteCell(testBucket, []byte("old")),
+		NewPutDupsCell(dupBucket, []byte("d"), []byte("1"), []byte("2")),
+		NewPutDupsCell(dupBucket, []byte("e")),
+	}
+	ensure.True(tc, patch[1].Deleted() && patch[3].Deleted())
+	ensure.False(tc, patch[0].Deleted() || patch[2].Deleted())
+	ensure.DeepEqual(tc, patch.Len(), 4)
+	ensure.DeepEqual(tc, patch.Buckets(), []string{testBucket, dupBucket})
+	ensure.DeepEqual(tc, patch.InBucket(dupBucket), patch[2:])
+	ensure.DeepEqual(tc, patch.Filter(func(cell *PatchCell) bool { return cell.Deleted() }),
+		TxnPatch{patch[1], patch[3]})
+
+	data, err := patch.MarshalBinary()
+	ensure.Nil(tc, err)
+	ensure.DeepEqual(tc, patch.SizeBytes(), len(data))
+
+	var visited []CellKey
+	stop := errors.New("stop")
+	err = patch.ForEach(func(cell *PatchCell) error {
+		visited = append(visited, cell.CellKey())
+		if len(visited) == 2 {
+			return stop
+		}
+		return nil
+	})
+	ensure.True(tc, err == stop)
+	ensure.DeepEqual(tc, visited, []CellKey{{testBucket, []byte("new")}, {testBucket, []byte("old")}})
+
+	ensure.Nil(tc, db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		return txn.ApplyPatch(patch)
+	}))
+	made, err := MakePatch(db, func(txn *ReadWriteTxn) error {
+		return txn.ApplyPatch(patch)
+	})
+	ensure.Nil(tc, err)
+	patch.Sort()
+	ensure.DeepEqual(tc, made, patch)
+}
+
+func TestTxnPatch_Reversible(tc *testing.T) {
+	path, db := openDupSortDb("lmdb_test")
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		txn.Put(testBucket, []byte("a"), []byte("1"))
+		txn.Put(testBucket, []byte("b"), []byte("2"))
+		txn.PutDup(dupBucket, []byte("d"), []byte("1"))
+		txn.PutDup(dupBucket, []byte("d"), []byte("2"))
+		return nil
+	})
+	before := MakePatchOfDb(db)
+
+	tx := func(txn *ReadWriteTxn) error {
+		txn.Put(testBucket, []byte("a"), []byte("10"))
+		txn.Delete(testBucket, []byte("b"))
+		txn.TransactionalRW(func(txn *ReadWriteTxn) error {
+			txn.Put(testBucket, []byte("a"), []byte("11"))
+			txn.Put(testBucket, []byte("c"), []byte("3"))
+			return nil
+		})
+		txn.TransactionalRW(func(txn *ReadWriteTxn) error {
+			txn.Put(testBucket, []byte("e"), []byte("5"))
+			return errors.New("dummy error")
+		})
+		txn.PutDup(dupBucket, []byte("d"), []byte("3"))
+		txn.DeleteDup(dupBucket, []byte("d"), []byte("1"))
+		return nil
+	}
+	patch, err := MakeReversiblePatch(db, tx)
+	ensure.Nil(tc, err)
+	ensure.DeepEqual(tc, patch, TxnPatch{
+		{testBucket, []byte("a"), CellState{true, []byte("11"), nil}, &CellState{true, []byte("1"), nil}, false},
+		{testBucket, []byte("b"), CellState{}, &CellState{true, []byte("2"), nil}, false},
+		{testBucket, []byte("c"), CellState{true, []byte("3"), nil}, &CellState{}, false},
+		{dupBucket, []byte("d"), CellState{true, nil, [][]byte{[]byte("2"), []byte("3")}},
+			&CellState{true, nil, [][]byte{[]byte("1"), []byte("2")}}, false},
+	})
+
+	data, err := patch.MarshalBinary()
+	ensure.Nil(tc, err)
+	ensure.DeepEqual(tc, patch.SizeBytes(), len(data))
+	var decoded TxnPatch
+	ensure.Nil(tc, decoded.UnmarshalBinary(data))
+	ensure.DeepEqual(tc, decoded, patch)
+
+	inv, err := patch.Inverse()
+	ensure.Nil(tc, err)
+	ensure.True(tc, inv.IsCanonical())
+	invInv, err := inv.Inverse()
+	ensure.Nil(tc, err)
+	ensure.DeepEqual(tc, invInv, patch)
+
+	ensure.Nil(tc, db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		return txn.ApplyPatch(patch)
+	}))
+	ensure.Nil(tc, db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		return txn.ApplyPatch(inv)
+	}))
+	ensure.DeepEqual(tc, MakePatchOfDb(db), before)
+	db.TransactionalR(func(txn ReadTxner) {
+		dups := txn.(DupSortReader).GetAll(dupBucket, []byte("d"))
+		ensure.DeepEqual(tc, dups, [][]byte{[]byte("1"), []byte("2")})
+	})
+
+	// without priors
+	patch, err = MakePatch(db, tx)
+	ensure.Nil(tc, err)
+	_, err = patch.Inverse()
+	ensure.True(tc, errors.Is(err, ErrNotReversible))
+}
+
+func TestTxnPatch_ApplyIfUnchanged(tc *testing.T) {
+	path, db := openDupSortDb("lmdb_test")
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		txn.Put(testBucket, []byte("a"), []byte("1"))
+		txn.Put(testBucket, []byte("b"), []byte("2"))
+		txn.PutDup(dupBucket, []byte("d"), []byte("1"))
+		return nil
+	})
+	patch, err := MakeReversiblePatch(db, func(txn *ReadWriteTxn) error {
+		txn.Put(testBucket, []byte("a"), []byte("10"))
+		txn.Put(testBucket, []byte("b"), []byte("20"))
+		txn.Put(testBucket, []byte("c"), []byte("30"))
+		txn.PutDup(dupBucket, []byte("d"), []byte("2"))
+		return nil
+	})
+	ensure.Nil(tc, err)
+
+	// concurrent changes
+	db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		txn.Put(testBucket, []byte("b"), []byte("200"))
+		txn.Put(testBucket, []byte("c"), []byte("300"))
+		txn.PutDup(dupBucket, []byte("d"), []byte("0"))
+		return nil
+	})
+	err = db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		return txn.ApplyPatchIfUnchanged(patch)
+	})
+	ensure.True(tc, errors.Is(err, ErrConflict))
+	var conflict *ConflictError
+	ensure.True(tc, errors.As(err, &conflict))
+	ensure.DeepEqual(tc, conflict.Keys, []CellKey{
+		{testBucket, []byte("b")}, {testBucket, []byte("c")}, {dupBucket, []byte("d")}})
+	db.TransactionalR(func(txn ReadTxner) {
+		v, _ := txn.Get(testBucket, []byte("a"))
+		ensure.DeepEqual(tc, v, []byte("1"))
+	})
+
+	// back to the state the patch was made against
+	db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		txn.Put(testBucket, []byte("b"), []byte("2"))
+		txn.Delete(testBucket, []byte("c"))
+		txn.DeleteDup(dupBucket, []byte("d"), []byte("0"))
+		return nil
+	})
+	ensure.Nil(tc, db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		return txn.ApplyPatchIfUnchanged(patch)
+	}))
+	db.TransactionalR(func(txn ReadTxner) {
+		v, _ := txn.Get(testBucket, []byte("a"))
+		ensure.DeepEqual(tc, v, []byte("10"))
+	})
+
+	patch[0].Prior = nil
+	err = db.TransactionalRW(func(txn *ReadWriteTxn) error {
+		return txn.ApplyPatchIfUnchanged(patch)
+	})
+	ensure.True(tc, errors.Is(err, ErrNotReversible))
+}
+
+func TestTxnPatch_Squash(tc *testing.T) {
+	path1, db1 := openDupSortDb("lmdb_test")
+	defer os.RemoveAll(path1)
+	defer db1.Close()
+	path2, db2 := openDupSortDb("lmdb_test")
+	defer os.RemoveAll(path2)
+	defer db2.Close()
+
+	for _, db := range []*Database{db1, db2} {
+		db.TransactionalRW(func(txn *ReadWriteTxn) error {
+			txn.Put(testBucket, []byte("a"), []byte("0"))
+			txn.PutDup(dupBucket, []byte("d"), []byte("0"))
+			return nil
+		})
+	}
+	before := MakePatchOfDb(db2)
+
+	txs := []func(*ReadWriteTxn) error{
+		func(txn *ReadWriteTxn) error {
+			txn.Put(testBucket, []byte("a"), []byte("1"))
+			txn.Put(testBucket, []byte("b"), []byte("1"))
+			return nil
+		},
+		func(txn *ReadWriteTxn) error {
+			txn.Delete(testBucket, []byte("a"))
+			txn.PutDup(dupBucket, []byte("d"), []byte("2"))
+			return nil
+		},
+		func(txn *ReadWriteTxn) error {
+			txn.Put(testBucket, []byte("a"), []byte("3"))
+			txn.Delete(testBucket, []byte("b"))
+			return nil
+		},
+	}
+	var patches []TxnPatch
+	for _, tx := range txs {
+		patch, err := MakeReversiblePatch(db1, tx)
+		ensure.Nil(tc, err)
+		ensure.Nil(tc, db1.TransactionalRW(func(txn *ReadWriteTxn) error {
+			return txn.ApplyPatch(patch)
+		}))
+		patches = append(patches, patch)
+	}
+
+	squashed := SquashPatches(patches...)
+	ensure.True(tc, squashed.IsCanonical())
+	ensure.DeepEqual(tc, squashed, patches[0].Compose(patches[1]).Compose(patches[2]))
+	ensure.DeepEqual(tc, squashed, TxnPatch{
+		{testBucket, []byte("a"), CellState{true, []byte("3"), nil}, &CellState{true, []byte("0"), nil}, false},
+		{testBucket, []byte("b"), CellState{}, &CellState{}, false},
+		{dupBucket, []byte("d"), CellState{true, nil, [][]byte{[]byte("0"), []byte("2")}},
+			&CellState{true, nil, [][]byte{[]byte("0")}}, false},
+	})
+
+	ensure.Nil(tc, db2.TransactionalRW(func(txn *ReadWriteTxn) error {
+		return txn.ApplyPatchIfUnchanged(squashed)
+	}))
+	ensure.True(tc, IsEqualDb(db1, db2))
+
+	inv, err := squashed.Inverse()
+	ensure.Nil(tc, err)
+	ensure.Nil(tc, db2.TransactionalRW(func(txn *ReadWriteTxn) error {
+		return txn.ApplyPatch(inv)
+	}))
+	ensure.DeepEqual(tc, MakePatchOfDb(db2), before)
+}
+
+func TestTxnPatch_ClearBucket(tc *testing.T) {
+	init := func(txn *ReadWriteTxn) error {
+		txn.Put(testBucket, []byte("a"), []byte("1"))
+		txn.Put(testBucket, []byte("b"), []byte("2"))
+		txn.PutDup(dupBucket, []byte("d"), []byte("1"))
+		return nil
+	}
+	tx := func(txn *ReadWriteTxn) error {
+		txn.Put(testBucket, []byte("x"), []byte("9"))
+		txn.Put(testBucket, []byte("a"), []byte("10"))
+		txn.ClearBucket(testBucket)
+		txn.Put(testBucket, []byte("b"), []byte("20"))
+		txn.TransactionalRW(func(txn *ReadWriteTxn) error {
+			txn.Put(testBucket, []byte("y"), []byte("8"))
+			txn.Delete(testBucket, []byte("y"))
+			txn.ClearBucket(dupBucket)
+			return nil
+		})
+		txn.PutDup(dupBucket, []byte("d"), []byte("5"))
+		return nil
+	}
+
+	var dbs []*Database
+	for i := 0; i < 3; i++ {
+		path, db := openDupSortDb("lmdb_test")
+		defer os.RemoveAll(path)
+		defer db.Close()
+		db.TransactionalRW(init)
+		dbs = append(dbs, db)
+	}
+	before := MakePatchOfDb(dbs[0])
+
+	patch, err := MakePatch(dbs[0], tx)
+	ensure.Nil(tc, err)
+	ensure.DeepEqual(tc, patch, TxnPatch{
+		NewClearCell(testBucket),
+		NewPutCell(testBucket, []byte("b"), []byte("20")),
+		NewClearCell(dupBucket),
+		NewPutDupsCell(dupBucket, []byte("d"), []byte("5")),
+	})
+	data, err := patch.MarshalBinary()
+	ensure.Nil(tc, err)
+	var decoded TxnPatch
+	ensure.Nil(tc, decoded.UnmarshalBinary(data))
+	ensure.DeepEqual(tc, decoded, patch)
+
+	ensure.Nil(tc, dbs[0].TransactionalRW(tx))
+	ensure.Nil(tc, dbs[1].TransactionalRW(func(txn *ReadWriteTxn) error {
+		return txn.ApplyPatch(decoded)
+	}))
+	ensure.True(tc, IsEqualDb(dbs[0], dbs[1]))
+
+	// reversible
+	rpatch, err := MakeReversiblePatch(dbs[2], tx)
+	ensure.Nil(tc, err)
+	ensure.DeepEqual(tc, rpatch, TxnPatch{
+		{testBucket, nil, CellState{}, &CellState{}, true},
+		{testBucket, []byte("a"), CellState{}, &CellState{true, []byte("1"), nil}, false},
+		{testBucket, []byte("b"), CellState{true, []byte("20"), nil}, &CellState{true, []byte("2"), nil}, false},
+		{dupBucket, nil, CellState{}, &CellState{}, true},
+		{dupBucket, []byte("d"), CellState{true, nil, [][]byte{[]byte("5")}},
+			&CellState{true, nil, [][]byte{[]byte("1")}}, false},
+	})
+	dbs[2].TransactionalRW(func(txn *ReadWriteTxn) error {
+		txn.Put(testBucket, []byte("z"), []byte("0"))
+		return nil
+	})
+	err = dbs[2].TransactionalRW(func(txn *ReadWriteTxn) error {
+		return txn.ApplyPatchIfUnchanged(rpatch)
+	})
+	var conflict *ConflictError
+	ensure.True(tc, errors.As(err, &conflict))
+	ensure.DeepEqual(tc, conflict.Keys, []CellKey{{testBucket, []byte("z")}})
+	dbs[2].TransactionalRW(func(txn *ReadWriteTxn) error {
+		txn.Delete(testBucket, []byte("z"))
+		return txn.ApplyPatchIfUnchanged(rpatch)
+	})
+	ensure.True(tc, IsEqualDb(dbs[0], dbs[2]))
+
+	inv, err := rpatch.Inverse()
+	ensure.Nil(tc, err)
+	ensure.Nil(tc, dbs[2].TransactionalRW(func(txn *ReadWriteTxn) error {
+		return txn.ApplyPatch(inv)
+	}))
+	ensure.DeepEqual(tc, MakePatchOfDb(dbs[2]), before)
+
+	// a clear supersedes the earlier cells of its bucket
+	earlier := TxnPatch{
+		NewPutCell(testBucket, []byte("k"), []byte("1")),
+		NewPutDupsCell(dupBucket, []byte("d"), []byte("7")),
+	}
+	ensure.DeepEqual(tc, SquashPatches(earlier, patch), patch)
+}
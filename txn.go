@@ -1,7 +1,7 @@
 package lmdb
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	mdb "github.com/libreoscar/gomdb"
 )
@@ -13,39 +13,114 @@ type ReadTxner interface {
 	Iterate(bucket string) *Iterator
 }
 
+// The counterparts of the ReadTxner methods returning the errors instead of panicking,
+// implemented by the txns of this package.
+type TryReadTxner interface {
+	TryBucketStat(bucket string) (*Stat, error)
+	TryGet(bucket string, key []byte) ([]byte, bool, error)
+	TryGetNoCopy(bucket string, key []byte) ([]byte, bool, error)
+	TryIterate(bucket string) (*Iterator, error)
+}
+
 type ReadTxn struct {
-	// In this package, a DBI is obtained only through Open/Open2, and is never closed until
-	// Context.Close(), in which all dbis are closed automatically.
-	buckets map[string]mdb.DBI
-	txn     *mdb.Txn
+	db  *Database
+	txn *mdb.Txn
 	// Cached iterators in the current transaction, will be closed when txn finishes.
 	itrs []*Iterator
+	// Write txns only: buckets created or dropped (droppedBucket) in this txn and its committed
+	// nested txns. See buckets.go.
+	bucketChanges map[string]bucketInfo
+	// Write txns only: reads of the txn if tracked, see read_set.go.
+	reads *readSet
+	// See Context.
+	ctx context.Context
+	// Write txns only: the goroutine running the txn if DebugTxnGoroutine, else 0. See debug.go.
+	owner int64
+	// NoCopy results if DebugNoCopy, see nocopy.go.
+	noCopies []trackedCopy
+	// Top-level txns only: the txn is long-lived, registered in heldTxns. See map_size.go.
+	held bool
+	// Read txns only: Database.bucketGen when the txn began, see buckets.go.
+	bucketGen uint64
 }
 
 type ReadWriteTxn struct {
 	env *mdb.Env
 	*ReadTxn
-	dirtyKeys map[string]bool // the key is serilized CellKey
+	// Keys changed while making a patch, see MakePatch. The key is the encoded CellKey, the value
+	// is the state before the patch if {recordPriors} (see MakeReversiblePatch), nil otherwise.
+	dirtyKeys    map[string]*CellState
+	recordPriors bool
+	keyBuf       []byte // to encode the CellKeys without allocating
+	// Buckets dropped in this txn and its committed nested txns, with their former info. They are
+	// deleted when the top-level txn commits, see buckets.go.
+	drops map[string]bucketInfo
 }
 
 //--------------------------------- ReadTxn -------------------------------------------------------
+//
+// Methods panic on unexpected LMDB errors (and on non-existing buckets). Each of them has a Try*
+// counterpart which returns the error instead.
+
+func (txn *ReadTxn) bucketInfo(bucket string) (bucketInfo, error) {
+	txn.checkOwner()
+	info, b := txn.bucketChanges[bucket]
+	if !b {
+		info, b = txn.db.bucket(bucket)
+		// a read txn sees neither the buckets being dropped nor those published after it began
+		b = b && (txn.bucketChanges != nil || !info.dropping && info.gen <= txn.bucketGen)
+	}
+	if !b || info.dbi == droppedBucket {
+		return bucketInfo{}, &Error{"open bucket", bucket, nil, ErrBucketNotFound}
+	}
+	return info, nil
+}
+
+func (txn *ReadTxn) bucketId(bucket string) (mdb.DBI, error) {
+	info, err := txn.bucketInfo(bucket)
+	return info.dbi, err
+}
 
 // panic if {bucket} does not exist, internal use
 func (txn *ReadTxn) getBucketId(bucket string) mdb.DBI {
-	id, b := txn.buckets[bucket]
-	if !b {
-		panic(fmt.Errorf("bucket does not exist: %s", bucket))
-	} else {
-		return id
+	id, err := txn.bucketId(bucket)
+	if err != nil {
+		panic(err)
 	}
+	return id
 }
 
-func (txn *ReadTxn) BucketStat(bucket string) *Stat {
-	stat, err := txn.txn.Stat(txn.getBucketId(bucket))
+func (txn *ReadTxn) TryBucketStat(bucket string) (*Stat, error) {
+	id, err := txn.bucketId(bucket)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := txn.txn.Stat(id)
 	if err != nil { // Possible errors: EINVAL, MDB_BAD_TXN
+		return nil, wrapError("stat", bucket, nil, err)
+	}
+	return (*Stat)(stat), nil
+}
+
+func (txn *ReadTxn) BucketStat(bucket string) *Stat {
+	stat, err := txn.TryBucketStat(bucket)
+	if err != nil {
 		panic(err)
 	}
-	return (*Stat)(stat)
+	return stat
+}
+
+// Closes the iterators opened since there were {n}.
+func (txn *ReadTxn) closeIterators(n int) {
+	for _, itr := range txn.itrs[n:] {
+		itr.Close()
+	}
+	txn.itrs = txn.itrs[:n]
+}
+
+func (txn *ReadTxn) TryIsBucketEmpty(bucket string) (bool, error) {
+	itr, err := txn.TryIterate(bucket)
+	return itr == nil, err
 }
 
 // Panic if {bucket} does not exist.
@@ -53,89 +128,162 @@ func (txn *ReadTxn) IsBucketEmpty(bucket string) bool {
 	return txn.Iterate(bucket) == nil
 }
 
+func (txn *ReadTxn) getVal(bucket string, key []byte) (mdb.Val, bool, error) {
+	info, err := txn.bucketInfo(bucket)
+	if err == nil {
+		err = txn.checkSizes("get", bucket, info, key, nil)
+	}
+	if err != nil {
+		return mdb.Val{}, false, err
+	}
+	v, err := txn.txn.GetVal(info.dbi, key)
+	if err == mdb.NotFound {
+		return mdb.Val{}, false, nil
+	} else if err != nil { // Possible errors: EINVAL, MDB_BAD_TXN, MDB_BAD_VALSIZE, etc
+		return mdb.Val{}, false, wrapError("get", bucket, key, err)
+	}
+	return v, true, nil
+}
+
+func (txn *ReadTxn) TryGet(bucket string, key []byte) ([]byte, bool, error) {
+	txn.reads.recordKey(bucket, key)
+	v, exist, err := txn.getVal(bucket, key)
+	if !exist {
+		return nil, false, err
+	}
+	return v.Bytes(), true, nil
+}
+
 // Return {nil, false} if {key} does not exist, {val, true} if {key} exist
 func (txn *ReadTxn) Get(bucket string, key []byte) ([]byte, bool) {
-	v, err := txn.txn.GetVal(txn.getBucketId(bucket), key)
+	v, exist, err := txn.TryGet(bucket, key)
 	if err != nil {
-		if err == mdb.NotFound {
-			return nil, false
-		} else { // Possible errors: EINVAL, MDB_BAD_TXN, MDB_BAD_VALSIZE, etc
-			panic(err)
-		}
+		panic(err)
+	}
+	return v, exist
+}
+
+func (txn *ReadTxn) TryGetNoCopy(bucket string, key []byte) ([]byte, bool, error) {
+	txn.reads.recordKey(bucket, key)
+	v, exist, err := txn.getVal(bucket, key)
+	if !exist {
+		return nil, false, err
 	}
-	return v.Bytes(), true
+	return txn.trackNoCopy(v.BytesNoCopy()), true, nil
 }
 
 // 1) Return {nil, false} if {key} does not exist, {val, true} if {key} exist
 func (txn *ReadTxn) GetNoCopy(bucket string, key []byte) ([]byte, bool) {
-	v, err := txn.txn.GetVal(txn.getBucketId(bucket), key)
+	v, exist, err := txn.TryGetNoCopy(bucket, key)
+	if err != nil {
+		panic(err)
+	}
+	return v, exist
+}
+
+// The state of {key}, with all its values for DupSort buckets. Not recorded as a read.
+func (txn *ReadTxn) tryGetCellState(bucket string, key []byte) (state CellState, err error) {
+	info, err := txn.bucketInfo(bucket)
 	if err != nil {
-		if err == mdb.NotFound {
-			return nil, false
-		} else { // Possible errors: EINVAL, MDB_BAD_TXN, MDB_BAD_VALSIZE, etc
-			panic(err)
+		return
+	}
+	if info.flags&DupSort != 0 {
+		state.Values, err = txn.getAll(bucket, key)
+		state.Exists = state.Values != nil
+	} else {
+		var v mdb.Val
+		if v, state.Exists, err = txn.getVal(bucket, key); state.Exists {
+			state.Value = v.Bytes()
 		}
 	}
-	return v.BytesNoCopy(), true
+	return
 }
 
-// Return an iterator pointing to the first item in the bucket.
-// If the bucket is empty, nil is returned.
-func (txn *ReadTxn) Iterate(bucket string) *Iterator {
-	cur, err := txn.txn.CursorOpen(txn.getBucketId(bucket))
+func (txn *ReadTxn) TryIterate(bucket string) (*Iterator, error) {
+	info, err := txn.bucketInfo(bucket)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	cur, err := txn.txn.CursorOpen(info.dbi)
+	if err != nil {
+		return nil, wrapError("open cursor", bucket, nil, err)
 	}
 
-	itr := (*Iterator)(cur)
+	itr := newIterator(cur, iterState{reads: txn.reads, bucket: bucket, owner: txn.owner, txn: txn,
+		dbi: info.dbi, gen: txn.bucketGen})
 
-	if itr.SeekFirst() {
+	ok, err := itr.TrySeekFirst()
+	if ok {
 		txn.itrs = append(txn.itrs, itr)
-		return itr
+		return itr, nil
 	} else {
 		itr.Close()
-		return nil
+		return nil, err
+	}
+}
+
+// Return an iterator pointing to the first item in the bucket.
+// If the bucket is empty, nil is returned.
+func (txn *ReadTxn) Iterate(bucket string) *Iterator {
+	itr, err := txn.TryIterate(bucket)
+	if err != nil {
+		panic(err)
 	}
+	return itr
 }
 
 //--------------------------------- ReadWriteTxn --------------------------------------------------
 
+// Errors from beginning or committing the nested txn are returned rather than panicking.
 func (parent *ReadWriteTxn) TransactionalRW(f func(*ReadWriteTxn) error) (err error) {
+	parent.checkOwner()
 	txn, err := parent.env.BeginTxn(parent.txn, 0)
 	if err != nil { // Possible Errors: MDB_PANIC, MDB_MAP_RESIZED, MDB_READERS_FULL, ENOMEM
-		panic(err)
+		return wrapError("begin nested txn", "", nil, err)
 	}
 
 	var panicF interface{} // panic from f
-	var subDirtyKeys map[string]bool
+	var subDirtyKeys map[string]*CellState
 	if parent.dirtyKeys != nil {
-		subDirtyKeys = make(map[string]bool)
+		subDirtyKeys = make(map[string]*CellState)
 	}
-	rwCtx := ReadWriteTxn{parent.env, &ReadTxn{parent.buckets, txn, nil}, subDirtyKeys}
+	rwCtx := ReadWriteTxn{env: parent.env, ReadTxn: &ReadTxn{db: parent.db, txn: txn},
+		dirtyKeys: subDirtyKeys, recordPriors: parent.recordPriors}
+	rwCtx.bucketChanges = copyBucketChanges(parent.bucketChanges)
+	rwCtx.drops = copyBucketChanges(parent.drops)
+	rwCtx.reads = parent.reads.child()
+	rwCtx.ctx, rwCtx.owner = parent.ctx, parent.owner
 
 	defer func() {
 		for _, itr := range rwCtx.itrs {
 			itr.Close() // no panic
 		}
 		rwCtx.itrs = nil
+		rwCtx.endNoCopies()
+		parent.reads.merge(rwCtx.reads) // even if rolled back, see read_set.go
 
 		if err == nil && panicF == nil {
-			e := txn.Commit()
-			if e != nil { // Possible errors: EINVAL, ENOSPEC, EIO, ENOMEM
-				panic(e)
-			}
-
-			if (parent.dirtyKeys == nil) != (rwCtx.dirtyKeys == nil) {
-				panic(fmt.Errorf("unexpected error"))
-			}
-			for dirtyKey := range rwCtx.dirtyKeys {
-				parent.dirtyKeys[dirtyKey] = true
+			// Possible errors: EINVAL, ENOSPEC, EIO, ENOMEM
+			err = wrapError("commit nested txn", "", nil, txn.Commit())
+			if err == nil {
+				if (parent.dirtyKeys == nil) != (rwCtx.dirtyKeys == nil) {
+					panic(fmt.Errorf("unexpected error"))
+				}
+				for dirtyKey, prior := range rwCtx.dirtyKeys {
+					// the state before the patch is the one recorded first
+					if _, dirty := parent.dirtyKeys[dirtyKey]; !dirty {
+						parent.dirtyKeys[dirtyKey] = prior
+					}
+				}
+				parent.bucketChanges, parent.drops = rwCtx.bucketChanges, rwCtx.drops
+				return
 			}
 		} else {
 			txn.Abort()
-			if panicF != nil {
-				panic(panicF) // re-panic
-			}
+		}
+
+		if panicF != nil {
+			panic(panicF) // re-panic
 		}
 	}()
 
@@ -149,47 +297,223 @@ func (parent *ReadWriteTxn) TransactionalRW(f func(*ReadWriteTxn) error) (err er
 	return
 }
 
+// Stops at, and returns, the first error.
 func (txn *ReadWriteTxn) ApplyPatch(patch TxnPatch) error {
+	return applyPatch(txn, patch)
+}
+
+func applyPatch(txn ReadWriteTxner, patch TxnPatch) error {
 	for _, cell := range patch {
-		if cell.exists {
-			txn.Put(cell.bucket, cell.key, cell.value)
+		var err error
+		if cell.IsClear() {
+			err = txn.TryClearBucket(cell.Bucket)
+		} else if cell.Exists && cell.Values == nil {
+			err = txn.TryPut(cell.Bucket, cell.Key, cell.Value)
 		} else {
-			txn.Delete(cell.bucket, cell.key)
+			err = txn.TryDelete(cell.Bucket, cell.Key)
+			for i := 0; i < len(cell.Values) && err == nil; i++ {
+				err = txn.TryPutDup(cell.Bucket, cell.Key, cell.Values[i])
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Applies the reversible {patch} (see MakeReversiblePatch) only if the current state of each of
+// its keys is the prior state recorded in the patch, and the buckets it clears have no other keys.
+// Else returns a *ConflictError listing the keys which differ, and changes nothing.
+func (txn *ReadWriteTxn) ApplyPatchIfUnchanged(patch TxnPatch) error {
+	checked := make(map[string]bool)
+	var cleared []string
+	var conflicts []CellKey
+	for i := range patch {
+		cell := &patch[i]
+		if cell.Prior == nil {
+			return &Error{"apply patch", cell.Bucket, cell.Key, ErrNotReversible}
+		}
+		// the priors of the later cells of a key are set by the first one
+		cellKey := cell.CellKey().Encode()
+		if checked[cellKey] {
+			continue
+		}
+		checked[cellKey] = true
+		if cell.IsClear() {
+			cleared = append(cleared, cell.Bucket)
+			continue
+		}
+
+		state, err := txn.tryGetCellState(cell.Bucket, cell.Key)
+		if err != nil {
+			return err
+		}
+		if !state.equal(cell.Prior) {
+			conflicts = append(conflicts, cell.CellKey())
+		}
+	}
+	// keys a clear would delete without the patch knowing them
+	for _, bucket := range cleared {
+		err := txn.forEachKey(bucket, func(key []byte) error {
+			if !checked[CellKey{bucket, key}.Encode()] {
+				conflicts = append(conflicts, CellKey{bucket, append([]byte{}, key...)})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if conflicts != nil {
+		return &ConflictError{conflicts}
+	}
+	return txn.ApplyPatch(patch)
+}
+
+// Deletes all the keys of the bucket. Recorded as a clear cell when making a patch.
+func (txn *ReadWriteTxn) TryClearBucket(bucket string) error {
+	info, err := txn.bucketInfo(bucket)
+	if err == nil {
+		err = txn.markCleared(bucket)
+	}
+	if err != nil {
+		return err
+	}
+	err = txn.txn.Drop(info.dbi, 0) // Possible errors: EINVAL, EACCES, MDB_BAD_DBI
+	return wrapError("clear bucket", bucket, nil, err)
+}
+
+// Calls {f} on each key of {bucket} (once per key in DupSort buckets). {key} is only valid
+// during the call.
+func (txn *ReadTxn) forEachKey(bucket string, f func(key []byte) error) error {
+	id, err := txn.bucketId(bucket)
+	if err != nil {
+		return err
+	}
+	cur, err := txn.txn.CursorOpen(id)
+	if err != nil {
+		return wrapError("open cursor", bucket, nil, err)
+	}
+	itr := newIterator(cur, iterState{bucket: bucket})
+	defer itr.Close()
+
+	ok, err := itr.TrySeekFirst()
+	for ok && err == nil {
+		var key []byte
+		if key, _, err = itr.TryGetNoCopy(); err == nil {
+			err = f(key)
+		}
+		if err == nil {
+			ok, err = itr.TryNextNoDup()
+		}
+	}
+	return err
+}
+
+// Records {bucket} as cleared by the patch being made (if any). If the patch is reversible, the
+// keys of the bucket are recorded with their current state first. Called before the bucket is
+// cleared.
+func (txn *ReadWriteTxn) markCleared(bucket string) error {
+	if txn.dirtyKeys == nil {
+		return nil
+	}
+
+	var prior *CellState
+	if txn.recordPriors {
+		err := txn.forEachKey(bucket, func(key []byte) error {
+			return txn.markDirty(bucket, key)
+		})
+		if err != nil {
+			return err
 		}
+		prior = &CellState{} // the states of the keys are recorded by their cells
+	}
+
+	cellKey := CellKey{bucket, nil}.Encode()
+	if _, cleared := txn.dirtyKeys[cellKey]; !cleared {
+		txn.dirtyKeys[cellKey] = prior
 	}
 	return nil
 }
 
 func (txn *ReadWriteTxn) ClearBucket(bucket string) {
-	err := txn.txn.Drop(txn.getBucketId(bucket), 0)
-	if err != nil { // Possible errors: EINVAL, EACCES, MDB_BAD_DBI
+	err := txn.TryClearBucket(bucket)
+	if err != nil {
 		panic(err)
 	}
+}
 
-	if txn.dirtyKeys != nil {
-		// currently we do not support this operation when making a TxnPatch
-		panic(errors.New("Encountered ClearBucket operation when making a TxnPatch"))
+func (txn *ReadWriteTxn) TryPut(bucket string, key, val []byte) error {
+	info, err := txn.bucketInfo(bucket)
+	if err == nil {
+		err = txn.checkSizes("put", bucket, info, key, val)
+	}
+	if err == nil {
+		err = txn.markDirty(bucket, key)
+	}
+	if err != nil {
+		return err
+	}
+	err = txn.txn.Put(info.dbi, key, val, 0)
+	if err != nil { // Possible errors: MDB_MAP_FULL, MDB_TXN_FULL, EACCES, EINVAL
+		return wrapError("put", bucket, key, err)
 	}
+	return nil
 }
 
 func (txn *ReadWriteTxn) Put(bucket string, key, val []byte) {
-	err := txn.txn.Put(txn.getBucketId(bucket), key, val, 0)
-	if err != nil { // Possible errors: MDB_MAP_FULL, MDB_TXN_FULL, EACCES, EINVAL
+	err := txn.TryPut(bucket, key, val)
+	if err != nil {
 		panic(err)
 	}
+}
+
+// Deleting a non-existing key is not an error.
+func (txn *ReadWriteTxn) TryDelete(bucket string, key []byte) error {
+	info, err := txn.bucketInfo(bucket)
+	if err == nil {
+		err = txn.checkSizes("delete", bucket, info, key, nil)
+	}
+	if err == nil {
+		err = txn.markDirty(bucket, key)
+	}
+	if err != nil {
+		return err
+	}
+	err = txn.txn.Del(info.dbi, key, nil)
+	if err != nil && err != mdb.NotFound { // Possible errors: EINVAL, EACCES, MDB_BAD_TXN
+		return wrapError("delete", bucket, key, err)
+	}
+	return nil
+}
+
+// Records {key} as changed by the patch being made (if any), with its current state if the patch
+// is reversible. Called before the key is changed.
+func (txn *ReadWriteTxn) markDirty(bucket string, key []byte) error {
+	if txn.dirtyKeys == nil || len(key) == 0 { // an empty key is the clear mark, and not writable
+		return nil
+	}
+	txn.keyBuf = CellKey{bucket, key}.AppendEncoded(txn.keyBuf[:0])
+	if _, dirty := txn.dirtyKeys[string(txn.keyBuf)]; dirty {
+		return nil
+	}
 
-	if txn.dirtyKeys != nil {
-		txn.dirtyKeys[CellKey{bucket, key}.Serialize()] = true
+	var prior *CellState
+	if txn.recordPriors {
+		state, err := txn.tryGetCellState(bucket, key)
+		if err != nil {
+			return err
+		}
+		prior = &state
 	}
+	txn.dirtyKeys[string(txn.keyBuf)] = prior
+	return nil
 }
 
 func (txn *ReadWriteTxn) Delete(bucket string, key []byte) {
-	err := txn.txn.Del(txn.getBucketId(bucket), key, nil)
-	if err != nil && err != mdb.NotFound { // Possible errors: EINVAL, EACCES, MDB_BAD_TXN
+	err := txn.TryDelete(bucket, key)
+	if err != nil {
 		panic(err)
 	}
-
-	if txn.dirtyKeys != nil {
-		txn.dirtyKeys[CellKey{bucket, key}.Serialize()] = true
-	}
 }